@@ -24,25 +24,64 @@
 //      score: document search score
 //      etag:
 //      kind: p=package, c=command, d=directory with no go files
+//      license: SPDX license identifier or "" if no license detected
+//      deprecated: 1 if the package is deprecated, otherwise 0
+//      weights: space separated term=weight pairs for the terms that rank
+//      the package higher when matched by a query
+// pkg:<id>:versions list: etags of the stored versions, newest first.
+// pkg:<id>:v:<etag> string: snappy compressed gob encoded doc.Package for a
+//      version. The -db-max-versions flag sets the number of versions kept.
 // index:<term> set: package ids for given search term
+// index:cmd:<term> set: command ids for given search term. Commands are
+//      matched only by queries with the is:command filter.
 // index:import:<path> set: packages with import path
 // index:project:<root> set: packages in project with root
+// index:kind:<kind> set: packages with kind p, c or d
+// index:platform:<goos or goarch> set: packages with files for the platform
+// index:platform:all set: packages without platform specific files
+// index:platform:allos set: packages with only GOARCH specific files
+// index:platform:allarch set: packages with only GOOS specific files
+// index:suggest:<prefix> set: packages with last path element starting with
+//      prefix. Prefixes with two to four runes are indexed. Longer prefixes
+//      cost more index entries per package, but reduce the number of
+//      candidates that Suggest filters by the full prefix.
+// terms:<prefix> set: search terms without a ':' starting with the two byte
+//      prefix. Used to find corrections for misspelled query terms.
 // block set: packages to block
+// block:reasons hash: blocked root, reason given to BlockWithReason
+// score zset: package id, document search score
+// weight:<term> zset: package id, document search score multiplied by the
+//      term weight minus one for the terms in the weights field of the
+//      package. Queries add these scores to the document score.
 // popular zset: package id, score
 // popular:0 string: scaled base time for popular scores
-// nextCrawl zset: package id, Unix time for next crawl
+// popular:day zset: package id, score with a one day half life
+// popular:day:0 string: scaled base time for popular:day scores
+// nextCrawl zset: package id, Unix time for next crawl. With the
+//      -db-crawl-importer-weight flag, Put divides the time until the next
+//      crawl by 1 + importers/importerCrawlScale and BumpCrawl schedules the
+//      packages with the most importers first.
 // newCrawl set: new paths to crawl
 // badCrawl set: paths that returned error when crawling.
+// index:alias:<path> set: import paths that path redirected to when crawled.
+//      Get falls back to this set when path is not found.
+// index:aliases:<path> set: import paths that redirected to path. The
+//      importers of these paths are included in Importers and ImporterCount.
+// tombstone:<path> string: set with a TTL to keep a deleted path out of
+//      newCrawl.
 
 // Package database manages storage for GoPkgDoc.
 package database
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math"
 	"net/url"
@@ -62,11 +101,22 @@ type Database struct {
 	Pool interface {
 		Get() redis.Conn
 	}
+
+	// Observer, if not nil, is notified of each command sent to the server.
+	Observer Observer
 }
 
 type Package struct {
 	Path     string `json:"path"`
 	Synopsis string `json:"synopsis,omitempty"`
+
+	// Kind is the stored kind of the package: p=package, c=command,
+	// d=directory with no go files. Packages and Related return u for
+	// paths that are not in the database.
+	Kind string `json:"kind,omitempty"`
+
+	// Deprecated is only set in query results.
+	Deprecated bool `json:"deprecated,omitempty"`
 }
 
 type byPath []Package
@@ -79,6 +129,13 @@ var (
 	redisServer      = flag.String("db-server", "redis://127.0.0.1:6379", "URI of Redis server.")
 	redisIdleTimeout = flag.Duration("db-idle-timeout", 250*time.Second, "Close Redis connections after remaining idle for this duration.")
 	redisLog         = flag.Bool("db-log", false, "Log database commands")
+	stopWordFile     = flag.String("db-stop-words", "", "File with search stop words to add to the default set.")
+	crawlWeighted    = flag.Bool("db-crawl-importer-weight", false, "Crawl packages with many importers more often.")
+	maxVersions      = flag.Int("db-max-versions", 0, "Number of crawled versions of each package to keep.")
+	indexDoc         = flag.Bool("db-index-doc", false, "Index terms from the package documentation.")
+	maxTermRunes     = flag.Int("db-max-term-runes", 40, "Do not index words longer than this number of runes.")
+	indexMethods     = flag.Bool("db-index-methods", false, "Index method names in addition to top-level function and type names.")
+	indexDeclDoc     = flag.Bool("db-index-decl-doc", false, "Index terms from the documentation of exported declarations.")
 )
 
 func dialDb() (c redis.Conn, err error) {
@@ -115,6 +172,14 @@ func dialDb() (c redis.Conn, err error) {
 
 // New creates a database configured from command line flags.
 func New() (*Database, error) {
+	if *stopWordFile != "" {
+		p, err := ioutil.ReadFile(*stopWordFile)
+		if err != nil {
+			return nil, err
+		}
+		SetStopWords(strings.Fields(string(p)))
+	}
+
 	pool := &redis.Pool{
 		Dial:        dialDb,
 		MaxIdle:     10,
@@ -132,12 +197,28 @@ func New() (*Database, error) {
 
 // Exists returns true if package with import path exists in the database.
 func (db *Database) Exists(path string) (bool, error) {
-	c := db.Pool.Get()
+	c := db.conn("Exists")
 	defer c.Close()
 	return redis.Bool(c.Do("HEXISTS", "ids", path))
 }
 
-var putScript = redis.NewScript(0, `
+// updateWeightsLua is prepended to the scripts that store the search score
+// and term weights of a package.
+const updateWeightsLua = `
+    -- updateWeights replaces the score and weight:<term> entries of package
+    -- id. It is called before the weights field of the package is updated.
+    local function updateWeights(id, score, weights)
+        for term in string.gmatch(redis.call('HGET', 'pkg:' .. id, 'weights') or '', '([^ =]+)=') do
+            redis.call('ZREM', 'weight:' .. term, id)
+        end
+        for term, w in string.gmatch(weights, '([^ =]+)=([^ ]+)') do
+            redis.call('ZADD', 'weight:' .. term, tonumber(score) * (tonumber(w) - 1), id)
+        end
+        redis.call('ZADD', 'score', score, id)
+    end
+`
+
+var putScript = redis.NewScript(0, updateWeightsLua+`
     local path = ARGV[1]
     local synopsis = ARGV[2]
     local score = ARGV[3]
@@ -146,6 +227,10 @@ var putScript = redis.NewScript(0, `
     local etag = ARGV[6]
     local kind = ARGV[7]
     local nextCrawl = ARGV[8]
+    local license = ARGV[9]
+    local maxVersions = tonumber(ARGV[10])
+    local deprecated = ARGV[11]
+    local weights = ARGV[12]
 
     local id = redis.call('HGET', 'ids', path)
     if not id then
@@ -156,6 +241,13 @@ var putScript = redis.NewScript(0, `
     if etag ~= '' and etag == redis.call('HGET', 'pkg:' .. id, 'clone') then
         terms = ''
         score = 0
+        weights = ''
+    elseif etag ~= '' and nextCrawl ~= '0' and etag == redis.call('HGET', 'pkg:' .. id, 'etag') then
+        redis.call('SREM', 'badCrawl', path)
+        redis.call('SREM', 'newCrawl', path)
+        redis.call('ZADD', 'nextCrawl', nextCrawl, id)
+        redis.call('HSET', 'pkg:' .. id, 'crawl', nextCrawl)
+        return 0
     end
 
     local update = {}
@@ -170,11 +262,23 @@ var putScript = redis.NewScript(0, `
     for term, x in pairs(update) do
         if x == 1 then
             redis.call('SREM', 'index:' .. term, id)
+            if not string.find(term, ':', 1, true) and redis.call('SCARD', 'index:' .. term) == 0 then
+                redis.call('SREM', 'terms:' .. string.sub(term, 1, 2), term)
+            end
         elseif x == 2 then 
             redis.call('SADD', 'index:' .. term, id)
+            if not string.find(term, ':', 1, true) then
+                redis.call('SADD', 'terms:' .. string.sub(term, 1, 2), term)
+            end
         end
     end
 
+    local oldKind = redis.call('HGET', 'pkg:' .. id, 'kind')
+    if oldKind and oldKind ~= kind then
+        redis.call('SREM', 'index:kind:' .. oldKind, id)
+    end
+    redis.call('SADD', 'index:kind:' .. kind, id)
+
     redis.call('SREM', 'badCrawl', path)
     redis.call('SREM', 'newCrawl', path)
 
@@ -183,13 +287,27 @@ var putScript = redis.NewScript(0, `
         redis.call('HSET', 'pkg:' .. id, 'crawl', nextCrawl)
     end
 
-    return redis.call('HMSET', 'pkg:' .. id, 'path', path, 'synopsis', synopsis, 'score', score, 'gob', gob, 'terms', terms, 'etag', etag, 'kind', kind)
+    if maxVersions > 0 and etag ~= '' then
+        local versions = 'pkg:' .. id .. ':versions'
+        redis.call('LREM', versions, 0, etag)
+        redis.call('LPUSH', versions, etag)
+        redis.call('SET', 'pkg:' .. id .. ':v:' .. etag, gob)
+        for _, old in ipairs(redis.call('LRANGE', versions, maxVersions, -1)) do
+            redis.call('DEL', 'pkg:' .. id .. ':v:' .. old)
+        end
+        redis.call('LTRIM', versions, 0, maxVersions - 1)
+    end
+
+    updateWeights(id, score, weights)
+
+    redis.call('HMSET', 'pkg:' .. id, 'path', path, 'synopsis', synopsis, 'score', score, 'gob', gob, 'terms', terms, 'etag', etag, 'kind', kind, 'license', license, 'deprecated', deprecated, 'weights', weights)
+    return 1
 `)
 
 var addCrawlScript = redis.NewScript(0, `
     for i=1,#ARGV do
         local pkg = ARGV[i]
-        if redis.call('HEXISTS', 'ids',  pkg) == 0  and redis.call('SISMEMBER', 'badCrawl', pkg) == 0 then
+        if redis.call('HEXISTS', 'ids',  pkg) == 0  and redis.call('SISMEMBER', 'badCrawl', pkg) == 0 and redis.call('EXISTS', 'tombstone:' .. pkg) == 0 then
             redis.call('SADD', 'newCrawl', pkg)
         end
     end
@@ -199,23 +317,45 @@ func (db *Database) AddNewCrawl(importPath string) error {
 	if !gosrc.IsValidRemotePath(importPath) {
 		return errors.New("bad path")
 	}
-	c := db.Pool.Get()
+	c := db.conn("AddNewCrawl")
 	defer c.Close()
 	_, err := addCrawlScript.Do(c, importPath)
 	return err
 }
 
-// Put adds the package documentation to the database.
-func (db *Database) Put(pdoc *doc.Package, nextCrawl time.Time) error {
-	c := db.Pool.Get()
+var putAliasScript = redis.NewScript(0, `
+    local alias = ARGV[1]
+    local path = ARGV[2]
+
+    redis.call('SADD', 'index:alias:' .. alias, path)
+    redis.call('SADD', 'index:aliases:' .. path, alias)
+    if redis.call('HEXISTS', 'ids',  path) == 0  and redis.call('SISMEMBER', 'badCrawl', path) == 0 and redis.call('EXISTS', 'tombstone:' .. path) == 0 then
+        redis.call('SADD', 'newCrawl', path)
+    end
+`)
+
+// PutAlias records that the crawler was redirected from alias to importPath
+// and adds importPath to the crawl queue. Get on alias returns the package
+// stored under importPath and the importers of alias are counted as
+// importers of importPath.
+func (db *Database) PutAlias(alias, importPath string) error {
+	if !gosrc.IsValidRemotePath(importPath) {
+		return errors.New("bad path")
+	}
+	c := db.conn("PutAlias")
 	defer c.Close()
+	_, err := putAliasScript.Do(c, alias, importPath)
+	return err
+}
 
+// putArgs returns the putScript arguments for the package documentation.
+func putArgs(pdoc *doc.Package, nextCrawl time.Time) ([]interface{}, error) {
 	score := documentScore(pdoc)
 	terms := documentTerms(pdoc, score)
 
 	var gobBuf bytes.Buffer
 	if err := gob.NewEncoder(&gobBuf).Encode(pdoc); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Truncate large documents.
@@ -230,13 +370,13 @@ func (db *Database) Put(pdoc *doc.Package, nextCrawl time.Time) error {
 		pdoc.Examples = nil
 		gobBuf.Reset()
 		if err := gob.NewEncoder(&gobBuf).Encode(pdoc); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	gobBytes, err := snappy.Encode(nil, gobBuf.Bytes())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	kind := "p"
@@ -252,30 +392,31 @@ func (db *Database) Put(pdoc *doc.Package, nextCrawl time.Time) error {
 		t = nextCrawl.Unix()
 	}
 
-	_, err = putScript.Do(c, pdoc.ImportPath, pdoc.Synopsis, score, gobBytes, strings.Join(terms, " "), pdoc.Etag, kind, t)
-	if err != nil {
-		return err
+	deprecated := 0
+	if pdoc.Deprecated {
+		deprecated = 1
 	}
 
-	if nextCrawl.IsZero() {
-		// Skip crawling related packages if this is not a full save.
-		return nil
-	}
+	return []interface{}{pdoc.ImportPath, pdoc.Synopsis, score, gobBytes, strings.Join(terms, " "), pdoc.Etag, kind, t, pdoc.License, *maxVersions, deprecated, formatWeights(documentTermWeights(pdoc, score))}, nil
+}
 
-	paths := make(map[string]bool)
-	for _, p := range pdoc.Imports {
-		if gosrc.IsValidRemotePath(p) {
-			paths[p] = true
-		}
-	}
-	for _, p := range pdoc.TestImports {
-		if gosrc.IsValidRemotePath(p) {
-			paths[p] = true
-		}
+// formatWeights formats term weights for the weights field of a package.
+func formatWeights(weights map[string]float64) string {
+	var pairs []string
+	for term, w := range weights {
+		pairs = append(pairs, term+"="+strconv.FormatFloat(w, 'g', -1, 64))
 	}
-	for _, p := range pdoc.XTestImports {
-		if gosrc.IsValidRemotePath(p) {
-			paths[p] = true
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// addRelatedPaths adds the paths of the packages related to pdoc to paths.
+func addRelatedPaths(paths map[string]bool, pdoc *doc.Package) {
+	for _, imports := range [][]string{pdoc.Imports, pdoc.TestImports, pdoc.XTestImports} {
+		for _, p := range imports {
+			if gosrc.IsValidRemotePath(p) {
+				paths[p] = true
+			}
 		}
 	}
 	if pdoc.ImportPath != pdoc.ProjectRoot && pdoc.ProjectRoot != "" {
@@ -284,15 +425,154 @@ func (db *Database) Put(pdoc *doc.Package, nextCrawl time.Time) error {
 	for _, p := range pdoc.Subdirectories {
 		paths[pdoc.ImportPath+"/"+p] = true
 	}
+}
 
+func addNewCrawls(c redis.Conn, paths map[string]bool) error {
 	args := make([]interface{}, 0, len(paths))
 	for p := range paths {
 		args = append(args, p)
 	}
-	_, err = addCrawlScript.Do(c, args...)
+	_, err := addCrawlScript.Do(c, args...)
 	return err
 }
 
+const (
+	// importerCrawlScale is the number of importers that halves the time
+	// until the next crawl.
+	importerCrawlScale = 100
+
+	// minCrawlInterval is the minimum time until the next crawl after
+	// weighting by importers.
+	minCrawlInterval = time.Hour
+)
+
+// weightCrawlTime moves the crawl time t toward now in proportion to n, the
+// number of importers of the package.
+func weightCrawlTime(now, t time.Time, n int) time.Time {
+	d := t.Sub(now)
+	if d <= minCrawlInterval {
+		return t
+	}
+	d = time.Duration(float64(d) / (1 + float64(n)/importerCrawlScale))
+	if d < minCrawlInterval {
+		d = minCrawlInterval
+	}
+	return now.Add(d)
+}
+
+// crawlTimes returns the next crawl time for each of the packages. With the
+// -db-crawl-importer-weight flag, nextCrawl is weighted by the number of
+// importers of each package.
+func crawlTimes(c redis.Conn, pdocs []*doc.Package, nextCrawl time.Time) ([]time.Time, error) {
+	times := make([]time.Time, len(pdocs))
+	if !*crawlWeighted || nextCrawl.IsZero() || len(pdocs) == 0 {
+		for i := range times {
+			times[i] = nextCrawl
+		}
+		return times, nil
+	}
+	for _, pdoc := range pdocs {
+		c.Send("SCARD", "index:import:"+pdoc.ImportPath)
+	}
+	counts, err := redis.Ints(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i, n := range counts {
+		times[i] = weightCrawlTime(now, nextCrawl, n)
+	}
+	return times, nil
+}
+
+// Put adds the package documentation to the database. If the etag matches
+// the stored etag and nextCrawl is set, only the crawl schedule is updated
+// and changed is false.
+func (db *Database) Put(pdoc *doc.Package, nextCrawl time.Time) (changed bool, err error) {
+	c := db.conn("Put")
+	defer c.Close()
+
+	times, err := crawlTimes(c, []*doc.Package{pdoc}, nextCrawl)
+	if err != nil {
+		return false, err
+	}
+	nextCrawl = times[0]
+
+	args, err := putArgs(pdoc, nextCrawl)
+	if err != nil {
+		return false, err
+	}
+
+	changed, err = redis.Bool(putScript.Do(c, args...))
+	if err != nil {
+		return false, err
+	}
+
+	if nextCrawl.IsZero() || !changed {
+		// Skip crawling related packages if this is not a full save or the
+		// related packages were added when the document was stored.
+		return changed, nil
+	}
+
+	paths := make(map[string]bool)
+	addRelatedPaths(paths, pdoc)
+	return changed, addNewCrawls(c, paths)
+}
+
+// PutBatch adds the documentation for the packages to the database. The
+// updates are sent to the server in a single round trip after the importer
+// counts are read for crawl weighting. An error for one
+// package does not prevent the other packages from being stored.
+func (db *Database) PutBatch(pdocs []*doc.Package, nextCrawl time.Time) error {
+	var errs []string
+
+	c := db.conn("PutBatch")
+	defer c.Close()
+
+	times, err := crawlTimes(c, pdocs, nextCrawl)
+	if err != nil {
+		return err
+	}
+
+	var sent []*doc.Package
+	for i, pdoc := range pdocs {
+		args, err := putArgs(pdoc, times[i])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", pdoc.ImportPath, err))
+			continue
+		}
+		if err := putScript.Send(c, args...); err != nil {
+			return err
+		}
+		sent = append(sent, pdoc)
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	paths := make(map[string]bool)
+	for _, pdoc := range sent {
+		// As in Put, skip the related packages if the document did not
+		// change.
+		if changed, err := redis.Bool(c.Receive()); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", pdoc.ImportPath, err))
+		} else if changed && !nextCrawl.IsZero() {
+			addRelatedPaths(paths, pdoc)
+		}
+	}
+
+	if len(paths) > 0 {
+		if err := addNewCrawls(c, paths); err != nil {
+			return err
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("put batch: " + strings.Join(errs, ", "))
+	}
+	return nil
+}
+
 var setNextCrawlEtagScript = redis.NewScript(0, `
     local root = ARGV[1]
     local etag = ARGV[2]
@@ -310,7 +590,7 @@ var setNextCrawlEtagScript = redis.NewScript(0, `
 
 // SetNextCrawlEtag sets the next crawl time for all packages in the project with the given etag.
 func (db *Database) SetNextCrawlEtag(projectRoot string, etag string, t time.Time) error {
-	c := db.Pool.Get()
+	c := db.conn("SetNextCrawlEtag")
 	defer c.Close()
 	_, err := setNextCrawlEtagScript.Do(c, normalizeProjectRoot(projectRoot), etag, t.Unix())
 	return err
@@ -319,9 +599,19 @@ func (db *Database) SetNextCrawlEtag(projectRoot string, etag string, t time.Tim
 var bumpCrawlScript = redis.NewScript(0, `
     local root = ARGV[1]
     local now = tonumber(ARGV[2])
+    local weighted = ARGV[3] == '1'
     local nextCrawl = now + 3600
     local pkgs = redis.call('SORT', 'index:project:' .. root, 'GET', '#')
 
+    if weighted then
+        local importers = {}
+        for i=1,#pkgs do
+            local path = redis.call('HGET', 'pkg:' .. pkgs[i], 'path') or ''
+            importers[pkgs[i]] = redis.call('SCARD', 'index:import:' .. path)
+        end
+        table.sort(pkgs, function(a, b) return importers[a] > importers[b] end)
+    end
+
     for i=1,#pkgs do
         local t = tonumber(redis.call('HGET', 'pkg:' .. pkgs[i], 'crawl') or 0)
         if t == 0 or now < t then
@@ -336,9 +626,9 @@ var bumpCrawlScript = redis.NewScript(0, `
 `)
 
 func (db *Database) BumpCrawl(projectRoot string) error {
-	c := db.Pool.Get()
+	c := db.conn("BumpCrawl")
 	defer c.Close()
-	_, err := bumpCrawlScript.Do(c, normalizeProjectRoot(projectRoot), time.Now().Unix())
+	_, err := bumpCrawlScript.Do(c, normalizeProjectRoot(projectRoot), time.Now().Unix(), *crawlWeighted)
 	return err
 }
 
@@ -346,6 +636,7 @@ func (db *Database) BumpCrawl(projectRoot string) error {
 // specified path. If path is "-", then the oldest document is returned.
 var getDocScript = redis.NewScript(0, `
     local path = ARGV[1]
+    local etag = ARGV[2]
 
     local id
     if path == '-' then
@@ -361,45 +652,58 @@ var getDocScript = redis.NewScript(0, `
         end
     end
 
-    local gob = redis.call('HGET', 'pkg:' .. id, 'gob')
+    local values = redis.call('HMGET', 'pkg:' .. id, 'gob', 'etag', 'crawl')
+    local gob = values[1]
     if not gob then
         return false
     end
 
-    local nextCrawl = redis.call('HGET', 'pkg:' .. id, 'crawl')
+    local nextCrawl = values[3]
     if not nextCrawl then 
         nextCrawl = redis.call('ZSCORE', 'nextCrawl', id)
         if not nextCrawl then
             nextCrawl = 0
         end
     end
+
+    if etag ~= '' and values[2] == etag then
+        return {'', nextCrawl}
+    end
     
     return {gob, nextCrawl}
 `)
 
 func (db *Database) getDoc(c redis.Conn, path string) (*doc.Package, time.Time, error) {
-	r, err := redis.Values(getDocScript.Do(c, path))
+	pdoc, nextCrawl, _, err := db.getDocIfChanged(c, path, "")
+	return pdoc, nextCrawl, err
+}
+
+func (db *Database) getDocIfChanged(c redis.Conn, path, etag string) (*doc.Package, time.Time, bool, error) {
+	r, err := redis.Values(getDocScript.Do(c, path, etag))
 	if err == redis.ErrNil {
-		return nil, time.Time{}, nil
+		return nil, time.Time{}, true, nil
 	} else if err != nil {
-		return nil, time.Time{}, err
+		return nil, time.Time{}, false, err
 	}
 
 	var p []byte
 	var t int64
 
 	if _, err := redis.Scan(r, &p, &t); err != nil {
-		return nil, time.Time{}, err
+		return nil, time.Time{}, false, err
 	}
 
-	p, err = snappy.Decode(nil, p)
-	if err != nil {
-		return nil, time.Time{}, err
+	if len(p) == 0 {
+		var nextCrawl time.Time
+		if t != 0 {
+			nextCrawl = time.Unix(t, 0).UTC()
+		}
+		return nil, nextCrawl, false, nil
 	}
 
-	var pdoc doc.Package
-	if err := gob.NewDecoder(bytes.NewReader(p)).Decode(&pdoc); err != nil {
-		return nil, time.Time{}, err
+	pdoc, err := decodeDoc(path, p)
+	if err != nil {
+		return nil, time.Time{}, false, err
 	}
 
 	nextCrawl := pdoc.Updated
@@ -407,7 +711,79 @@ func (db *Database) getDoc(c redis.Conn, path string) (*doc.Package, time.Time,
 		nextCrawl = time.Unix(t, 0).UTC()
 	}
 
-	return &pdoc, nextCrawl, err
+	return pdoc, nextCrawl, true, err
+}
+
+// ErrCorruptRecord matches the errors returned when a stored document cannot
+// be decoded. The caller can delete the package and crawl it again.
+var ErrCorruptRecord = errors.New("database: corrupt record")
+
+// CorruptRecordError is the error returned when the stored document for
+// Path cannot be decoded. Err is the snappy or gob decoding error.
+type CorruptRecordError struct {
+	Path string
+	Err  error
+}
+
+func (e *CorruptRecordError) Error() string {
+	return "database: corrupt record for " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *CorruptRecordError) Unwrap() error { return e.Err }
+
+// Is returns true if target is ErrCorruptRecord.
+func (e *CorruptRecordError) Is(target error) bool { return target == ErrCorruptRecord }
+
+// decodeDoc decodes the snappy compressed gob encoded doc.Package stored for
+// path.
+func decodeDoc(path string, p []byte) (*doc.Package, error) {
+	p, err := snappy.Decode(nil, p)
+	if err != nil {
+		return nil, &CorruptRecordError{Path: path, Err: err}
+	}
+	var pdoc doc.Package
+	if err := gob.NewDecoder(bytes.NewReader(p)).Decode(&pdoc); err != nil {
+		return nil, &CorruptRecordError{Path: path, Err: err}
+	}
+	return &pdoc, nil
+}
+
+var getDocVersionScript = redis.NewScript(0, `
+    local id = redis.call('HGET', 'ids', ARGV[1])
+    if not id then
+        return false
+    end
+    return redis.call('GET', 'pkg:' .. id .. ':v:' .. ARGV[2])
+`)
+
+// GetDocVersion returns the stored version of the package with the given
+// etag. The returned package is nil if the version is not stored.
+func (db *Database) GetDocVersion(path, etag string) (*doc.Package, error) {
+	c := db.conn("GetDocVersion")
+	defer c.Close()
+	p, err := redis.Bytes(getDocVersionScript.Do(c, path, etag))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeDoc(path, p)
+}
+
+var versionsScript = redis.NewScript(0, `
+    local id = redis.call('HGET', 'ids', ARGV[1])
+    if not id then
+        return {}
+    end
+    return redis.call('LRANGE', 'pkg:' .. id .. ':versions', 0, -1)
+`)
+
+// Versions returns the etags of the stored versions of a package, newest
+// first.
+func (db *Database) Versions(path string) ([]string, error) {
+	c := db.conn("Versions")
+	defer c.Close()
+	return redis.Strings(versionsScript.Do(c, path))
 }
 
 var getSubdirsScript = redis.NewScript(0, `
@@ -421,7 +797,7 @@ var getSubdirsScript = redis.NewScript(0, `
     return reply
 `)
 
-func (db *Database) getSubdirs(c redis.Conn, path string, pdoc *doc.Package) ([]Package, error) {
+func (db *Database) getSubdirs(c redis.Conn, path string, pdoc *doc.Package, dirs bool) ([]Package, error) {
 	var reply interface{}
 	var err error
 
@@ -459,7 +835,11 @@ func (db *Database) getSubdirs(c redis.Conn, path string, pdoc *doc.Package) ([]
 		if err != nil {
 			return nil, err
 		}
-		if (kind == "p" || kind == "c") && strings.HasPrefix(pkg.Path, prefix) {
+		if !strings.HasPrefix(pkg.Path, prefix) {
+			continue
+		}
+		pkg.Kind = kind
+		if kind == "p" || kind == "c" || kind == "d" && dirs {
 			subdirs = append(subdirs, pkg)
 		}
 	}
@@ -470,32 +850,165 @@ func (db *Database) getSubdirs(c redis.Conn, path string, pdoc *doc.Package) ([]
 // Get gets the package documenation and sub-directories for the the given
 // import path.
 func (db *Database) Get(path string) (*doc.Package, []Package, time.Time, error) {
-	c := db.Pool.Get()
+	c := db.conn("Get")
+	defer c.Close()
+	return db.get(c, path, false)
+}
+
+// GetWithDirs is like Get, but the subdirectories include directories
+// without documentation. These directories have Kind d.
+func (db *Database) GetWithDirs(path string) (*doc.Package, []Package, time.Time, error) {
+	c := db.conn("GetWithDirs")
 	defer c.Close()
+	return db.get(c, path, true)
+}
 
+func (db *Database) get(c redis.Conn, path string, dirs bool) (*doc.Package, []Package, time.Time, error) {
 	pdoc, nextCrawl, err := db.getDoc(c, path)
 	if err != nil {
 		return nil, nil, time.Time{}, err
 	}
 
+	if pdoc == nil {
+		// Follow a redirect recorded by PutAlias.
+		targets, err := redis.Strings(c.Do("SORT", "index:alias:"+path, "ALPHA", "LIMIT", 0, 1))
+		if err != nil {
+			return nil, nil, time.Time{}, err
+		}
+		if len(targets) > 0 {
+			pdoc, nextCrawl, err = db.getDoc(c, targets[0])
+			if err != nil {
+				return nil, nil, time.Time{}, err
+			}
+		}
+	}
+
 	if pdoc != nil {
 		// fixup for speclal "-" path.
 		path = pdoc.ImportPath
 	}
 
-	subdirs, err := db.getSubdirs(c, path, pdoc)
+	subdirs, err := db.getSubdirs(c, path, pdoc, dirs)
 	if err != nil {
 		return nil, nil, time.Time{}, err
 	}
 	return pdoc, subdirs, nextCrawl, nil
 }
 
+// GetContext is like Get, but returns ctx.Err() if the context is done before
+// the database replies. The read timeout of each command is set to the time
+// left before the context deadline. If the context is canceled while a
+// command is in progress, the connection is returned to the pool when the
+// command completes.
+func (db *Database) GetContext(ctx context.Context, path string) (*doc.Package, []Package, time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	c := db.observe("GetContext", contextConn{Conn: db.Pool.Get(), ctx: ctx})
+
+	var (
+		pdoc      *doc.Package
+		subdirs   []Package
+		nextCrawl time.Time
+		err       error
+	)
+	done := make(chan struct{})
+	go func() {
+		pdoc, subdirs, nextCrawl, err = db.get(c, path, false)
+		c.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return pdoc, subdirs, nextCrawl, err
+	case <-ctx.Done():
+		return nil, nil, time.Time{}, ctx.Err()
+	}
+}
+
+// contextConn is a connection that does not send commands after ctx is done
+// and that limits the time waiting for a reply to the deadline of ctx.
+type contextConn struct {
+	redis.Conn
+	ctx context.Context
+}
+
+// timeout returns the time left before the deadline of c.ctx or zero if
+// c.ctx does not have a deadline or c.Conn does not support timeouts.
+func (c contextConn) timeout() (time.Duration, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	deadline, ok := c.ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	if _, ok := c.Conn.(redis.ConnWithTimeout); !ok {
+		return 0, nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	return d, nil
+}
+
+func (c contextConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	d, err := c.timeout()
+	if err != nil {
+		return nil, err
+	}
+	if d == 0 {
+		return c.Conn.Do(cmd, args...)
+	}
+	reply, err := redis.DoWithTimeout(c.Conn, d, cmd, args...)
+	return reply, c.err(err)
+}
+
+func (c contextConn) Receive() (interface{}, error) {
+	d, err := c.timeout()
+	if err != nil {
+		return nil, err
+	}
+	if d == 0 {
+		return c.Conn.Receive()
+	}
+	reply, err := redis.ReceiveWithTimeout(c.Conn, d)
+	return reply, c.err(err)
+}
+
+// err returns the context error for an error caused by the read timeout.
+// The read can time out before the context timer marks the context done.
+func (c contextConn) err(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := c.ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
 func (db *Database) GetDoc(path string) (*doc.Package, time.Time, error) {
-	c := db.Pool.Get()
+	c := db.conn("GetDoc")
 	defer c.Close()
 	return db.getDoc(c, path)
 }
 
+// GetDocIfChanged is like GetDoc, but skips reading the documentation when
+// the stored etag matches the given etag. In that case, the returned package
+// is nil and changed is false. The next crawl time is zero if it is not
+// recorded separately from the documentation. If the package is not found,
+// the returned package is nil and changed is true.
+func (db *Database) GetDocIfChanged(path, etag string) (pdoc *doc.Package, nextCrawl time.Time, changed bool, err error) {
+	c := db.conn("GetDocIfChanged")
+	defer c.Close()
+	return db.getDocIfChanged(c, path, etag)
+}
+
 var deleteScript = redis.NewScript(0, `
     local path = ARGV[1]
 
@@ -506,24 +1019,142 @@ var deleteScript = redis.NewScript(0, `
 
     for term in string.gmatch(redis.call('HGET', 'pkg:' .. id, 'terms') or '', '([^ ]+)') do
         redis.call('SREM', 'index:' .. term, id)
+        if not string.find(term, ':', 1, true) and redis.call('SCARD', 'index:' .. term) == 0 then
+            redis.call('SREM', 'terms:' .. string.sub(term, 1, 2), term)
+        end
+    end
+
+    local kind = redis.call('HGET', 'pkg:' .. id, 'kind')
+    if kind then
+        redis.call('SREM', 'index:kind:' .. kind, id)
     end
 
+    for term in string.gmatch(redis.call('HGET', 'pkg:' .. id, 'weights') or '', '([^ =]+)=') do
+        redis.call('ZREM', 'weight:' .. term, id)
+    end
+    redis.call('ZREM', 'score', id)
+
     redis.call('ZREM', 'nextCrawl', id)
     redis.call('SREM', 'newCrawl', path)
     redis.call('ZREM', 'popular', id)
+    redis.call('ZREM', 'popular:day', id)
+    for _, etag in ipairs(redis.call('LRANGE', 'pkg:' .. id .. ':versions', 0, -1)) do
+        redis.call('DEL', 'pkg:' .. id .. ':v:' .. etag)
+    end
+    redis.call('DEL', 'pkg:' .. id .. ':versions')
     redis.call('DEL', 'pkg:' .. id)
     return redis.call('HDEL', 'ids', path)
 `)
 
 // Delete deletes the documenation for the given import path.
 func (db *Database) Delete(path string) error {
-	c := db.Pool.Get()
+	c := db.conn("Delete")
+	defer c.Close()
+	_, err := deleteScript.Do(c, path)
+	return err
+}
+
+// DeleteWithTombstone deletes the documentation for the given import path
+// and prevents the path from being added to the crawl queue for ttl. The ttl
+// must be at least one millisecond.
+func (db *Database) DeleteWithTombstone(path string, ttl time.Duration) error {
+	if ttl < time.Millisecond {
+		return errors.New("tombstone ttl less than one millisecond")
+	}
+	c := db.conn("DeleteWithTombstone")
 	defer c.Close()
+	// Set the tombstone first so that the path cannot be added to the crawl
+	// queue after the documentation is deleted.
+	if _, err := c.Do("SET", "tombstone:"+path, 1, "PX", int64(ttl/time.Millisecond)); err != nil {
+		return err
+	}
 	_, err := deleteScript.Do(c, path)
 	return err
 }
 
-func packages(reply interface{}, all bool) ([]Package, error) {
+// DeleteProject deletes the documentation for all packages in the project
+// with the given root and returns the number of packages deleted. Unlike
+// Block, the packages can be added back to the database by crawling.
+func (db *Database) DeleteProject(projectRoot string) (int, error) {
+	c := db.conn("DeleteProject")
+	defer c.Close()
+	paths, err := redis.Strings(c.Do("SORT", "index:project:"+normalizeProjectRoot(projectRoot), "BY", "nosort", "GET", "pkg:*->path"))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, path := range paths {
+		deleted, err := redis.Bool(deleteScript.Do(c, path))
+		switch {
+		case err == redis.ErrNil:
+			// Deleted by another client.
+		case err != nil:
+			return n, err
+		case deleted:
+			n++
+		}
+	}
+	return n, nil
+}
+
+type ProjectStats struct {
+	Packages  int            // number of packages in the project
+	Synopses  int            // packages with a non-empty synopsis
+	Kinds     map[string]int // number of packages by kind
+	Importers int            // distinct importers of the packages in the project
+}
+
+// ProjectStats returns aggregate statistics for the packages in the project
+// with the given root.
+func (db *Database) ProjectStats(projectRoot string) (*ProjectStats, error) {
+	c := db.conn("ProjectStats")
+	defer c.Close()
+	values, err := redis.Values(c.Do("SORT", "index:project:"+normalizeProjectRoot(projectRoot), "BY", "nosort", "GET", "pkg:*->path", "GET", "pkg:*->synopsis", "GET", "pkg:*->kind"))
+	if err != nil {
+		return nil, err
+	}
+	stats := ProjectStats{Kinds: make(map[string]int)}
+	var keys []interface{}
+	for len(values) > 0 {
+		var path, synopsis, kind string
+		values, err = redis.Scan(values, &path, &synopsis, &kind)
+		if err != nil {
+			return nil, err
+		}
+		stats.Packages++
+		if synopsis != "" {
+			stats.Synopses++
+		}
+		stats.Kinds[kind]++
+		keys = append(keys, "index:import:"+path)
+	}
+	if len(keys) == 0 {
+		return &stats, nil
+	}
+
+	n, err := redis.Int(c.Do("INCR", "maxQueryId"))
+	if err != nil {
+		return nil, err
+	}
+	tmp := "tmp:project-" + strconv.Itoa(n)
+	c.Send("SUNIONSTORE", append([]interface{}{tmp}, keys...)...)
+	c.Send("SCARD", tmp)
+	c.Send("DEL", tmp)
+	values, err = redis.Values(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	stats.Importers, err = redis.Int(values[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// packages converts a reply with the path, synopsis and kind of each package
+// to a slice of packages. If deprecated is true, the reply also has the
+// deprecated field of each package.
+func packages(reply interface{}, all bool, deprecated bool) ([]Package, error) {
 	values, err := redis.Values(reply, nil)
 	if err != nil {
 		return nil, err
@@ -532,10 +1163,15 @@ func packages(reply interface{}, all bool) ([]Package, error) {
 	for len(values) > 0 {
 		var pkg Package
 		var kind string
-		values, err = redis.Scan(values, &pkg.Path, &pkg.Synopsis, &kind)
+		dest := []interface{}{&pkg.Path, &pkg.Synopsis, &kind}
+		if deprecated {
+			dest = append(dest, &pkg.Deprecated)
+		}
+		values, err = redis.Scan(values, dest...)
 		if err != nil {
 			return nil, err
 		}
+		pkg.Kind = kind
 		if !all && kind == "d" {
 			continue
 		}
@@ -547,53 +1183,100 @@ func packages(reply interface{}, all bool) ([]Package, error) {
 	return result, nil
 }
 
-func (db *Database) getPackages(key string, all bool) ([]Package, error) {
-	c := db.Pool.Get()
+// getPackages returns the packages in the set key. The operation is observed
+// as name.
+func (db *Database) getPackages(name, key string, all bool) ([]Package, error) {
+	c := db.conn(name)
 	defer c.Close()
 	reply, err := c.Do("SORT", key, "ALPHA", "BY", "pkg:*->path", "GET", "pkg:*->path", "GET", "pkg:*->synopsis", "GET", "pkg:*->kind")
 	if err != nil {
 		return nil, err
 	}
-	return packages(reply, all)
+	return packages(reply, all, false)
 }
 
 func (db *Database) GoIndex() ([]Package, error) {
-	return db.getPackages("index:project:go", false)
+	return db.getPackages("GoIndex", "index:project:go", false)
 }
 
 func (db *Database) GoSubrepoIndex() ([]Package, error) {
-	return db.getPackages("index:project:subrepo", false)
+	return db.getPackages("GoSubrepoIndex", "index:project:subrepo", false)
 }
 
 func (db *Database) Index() ([]Package, error) {
-	return db.getPackages("index:all:", false)
+	return db.getPackages("Index", "index:all:", false)
 }
 
 func (db *Database) Project(projectRoot string) ([]Package, error) {
-	return db.getPackages("index:project:"+normalizeProjectRoot(projectRoot), true)
+	return db.getPackages("Project", "index:project:"+normalizeProjectRoot(projectRoot), true)
 }
 
 func (db *Database) AllPackages() ([]Package, error) {
-	c := db.Pool.Get()
-	defer c.Close()
-	values, err := redis.Values(c.Do("SORT", "nextCrawl", "DESC", "BY", "pkg:*->score", "GET", "pkg:*->path", "GET", "pkg:*->kind"))
-	if err != nil {
+	result := []Package{}
+	err := db.EachPackage(func(pkg Package) error {
+		result = append(result, pkg)
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
-	result := make([]Package, 0, len(values)/2)
-	for len(values) > 0 {
-		var pkg Package
-		var kind string
-		values, err = redis.Scan(values, &pkg.Path, &kind)
+	return result, nil
+}
+
+// eachPackageChunk is the number of packages fetched by each LRANGE in
+// EachPackage.
+const eachPackageChunk = 1000
+
+// eachPackageExpire is the time in seconds that the sorted package list of
+// EachPackage is kept after the last chunk is fetched. The list is deleted
+// when EachPackage returns, but expires if the caller never returns.
+const eachPackageExpire = 3600
+
+// EachPackage calls f for each package in the database in descending score
+// order. Directories are skipped. The paths and kinds are sorted once into a
+// temporary list that is read in chunks, so packages added or deleted during
+// the call are not seen.
+func (db *Database) EachPackage(f func(Package) error) error {
+	c := db.conn("EachPackage")
+	defer c.Close()
+	id, err := redis.Int(c.Do("INCR", "maxQueryId"))
+	if err != nil {
+		return err
+	}
+	tmp := "tmp:each-" + strconv.Itoa(id)
+	defer c.Do("DEL", tmp)
+	c.Send("SORT", "nextCrawl", "DESC", "BY", "pkg:*->score", "GET", "pkg:*->path", "GET", "pkg:*->kind", "STORE", tmp)
+	c.Send("EXPIRE", tmp, eachPackageExpire)
+	values, err := redis.Values(c.Do(""))
+	if err != nil {
+		return err
+	}
+	n, err := redis.Int(values[0], nil)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < n; start += 2 * eachPackageChunk {
+		c.Send("EXPIRE", tmp, eachPackageExpire)
+		values, err := redis.Values(c.Do("LRANGE", tmp, start, start+2*eachPackageChunk-1))
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if kind == "d" {
-			continue
+		for len(values) > 0 {
+			var pkg Package
+			var kind string
+			values, err = redis.Scan(values, &pkg.Path, &kind)
+			if err != nil {
+				return err
+			}
+			if kind == "d" {
+				continue
+			}
+			if err := f(pkg); err != nil {
+				return err
+			}
 		}
-		result = append(result, pkg)
 	}
-	return result, nil
+	return nil
 }
 
 var packagesScript = redis.NewScript(0, `
@@ -619,31 +1302,187 @@ func (db *Database) Packages(paths []string) ([]Package, error) {
 	for _, p := range paths {
 		args = append(args, p)
 	}
-	c := db.Pool.Get()
+	c := db.conn("Packages")
 	defer c.Close()
 	reply, err := packagesScript.Do(c, args...)
 	if err != nil {
 		return nil, err
 	}
-	pkgs, err := packages(reply, false)
+	pkgs, err := packages(reply, false, false)
 	sort.Sort(byPath(pkgs))
 	return pkgs, err
 }
 
+// importerKeysLua is prepended to the scripts that read the importers of a
+// path.
+const importerKeysLua = `
+    -- importerKeys returns the import sets for path and the aliases of path.
+    local function importerKeys(path)
+        local keys = {'index:import:' .. path}
+        for _, alias in ipairs(redis.call('SMEMBERS', 'index:aliases:' .. path)) do
+            keys[#keys+1] = 'index:import:' .. alias
+        end
+        return keys
+    end
+`
+
+var importerCountScript = redis.NewScript(0, importerKeysLua+`
+    local keys = importerKeys(ARGV[1])
+    if #keys == 1 then
+        return redis.call('SCARD', keys[1])
+    end
+    return #redis.call('SUNION', unpack(keys))
+`)
+
+// importersScript returns the key of a set with the importers of path and
+// the aliases of path. The key is a temporary key when path has aliases.
+var importersScript = redis.NewScript(0, importerKeysLua+`
+    local keys = importerKeys(ARGV[1])
+    if #keys == 1 then
+        return keys[1]
+    end
+    local tmp = 'tmp:importers-' .. redis.call('INCR', 'maxQueryId')
+    redis.call('SUNIONSTORE', tmp, unpack(keys))
+    redis.call('EXPIRE', tmp, 60)
+    return tmp
+`)
+
+// sortImporters sorts the importers of path and the aliases of path by path
+// and returns the path, synopsis and kind of each importer.
+func sortImporters(c redis.Conn, path string, args ...interface{}) ([]Package, error) {
+	key, err := redis.String(importersScript.Do(c, path))
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(key, "tmp:") {
+		defer c.Do("DEL", key)
+	}
+	args = append([]interface{}{key, "ALPHA", "BY", "pkg:*->path"}, args...)
+	reply, err := c.Do("SORT", append(args, "GET", "pkg:*->path", "GET", "pkg:*->synopsis", "GET", "pkg:*->kind")...)
+	if err != nil {
+		return nil, err
+	}
+	return packages(reply, false, false)
+}
+
 func (db *Database) ImporterCount(path string) (int, error) {
-	c := db.Pool.Get()
+	c := db.conn("ImporterCount")
 	defer c.Close()
-	return redis.Int(c.Do("SCARD", "index:import:"+path))
+	return redis.Int(importerCountScript.Do(c, path))
+}
+
+var relatedScript = redis.NewScript(0, `
+    local path = ARGV[1]
+    local count = tonumber(ARGV[2])
+
+    local tally = {}
+    for _, id in ipairs(redis.call('SMEMBERS', 'index:import:' .. path)) do
+        for p in string.gmatch(redis.call('HGET', 'pkg:' .. id, 'terms') or '', 'import:([^ ]+)') do
+            -- Skip the package and standard packages.
+            if p ~= path and string.find(p, '.', 1, true) then
+                tally[p] = (tally[p] or 0) + 1
+            end
+        end
+    end
+
+    local paths = {}
+    for p in pairs(tally) do
+        paths[#paths+1] = p
+    end
+    table.sort(paths, function(a, b)
+        if tally[a] ~= tally[b] then
+            return tally[a] > tally[b]
+        end
+        return a < b
+    end)
+
+    local result = {}
+    for i = 1,math.min(count, #paths) do
+        local synopsis = ''
+        local kind = 'u'
+        local id = redis.call('HGET', 'ids', paths[i])
+        if id then
+            synopsis = redis.call('HGET', 'pkg:' .. id, 'synopsis')
+            kind = redis.call('HGET', 'pkg:' .. id, 'kind')
+        end
+        result[#result+1] = paths[i]
+        result[#result+1] = synopsis
+        result[#result+1] = kind
+    end
+    return result
+`)
+
+// Related returns up to count packages that are most often imported together
+// with the package at path. Standard packages are not included.
+func (db *Database) Related(path string, count int) ([]Package, error) {
+	c := db.conn("Related")
+	defer c.Close()
+	reply, err := relatedScript.Do(c, path, count)
+	if err != nil {
+		return nil, err
+	}
+	return packages(reply, false, false)
+}
+
+// ImporterCounts returns the number of importers for each of the paths. The
+// counts are read in a single round trip to the server.
+func (db *Database) ImporterCounts(paths []string) (map[string]int, error) {
+	c := db.conn("ImporterCounts")
+	defer c.Close()
+	for _, path := range paths {
+		if err := importerCountScript.Send(c, path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(paths))
+	for _, path := range paths {
+		n, err := redis.Int(c.Receive())
+		if err != nil {
+			return nil, err
+		}
+		counts[path] = n
+	}
+	return counts, nil
 }
 
 func (db *Database) Importers(path string) ([]Package, error) {
-	return db.getPackages("index:import:"+path, false)
+	c := db.conn("Importers")
+	defer c.Close()
+	return sortImporters(c, path)
+}
+
+// ImportersPage returns limit importers of path starting at offset. Like
+// Importers, the importers are sorted by path.
+func (db *Database) ImportersPage(path string, offset, limit int) ([]Package, error) {
+	c := db.conn("ImportersPage")
+	defer c.Close()
+	return sortImporters(c, path, "LIMIT", offset, limit)
 }
 
 func (db *Database) Block(root string) error {
-	c := db.Pool.Get()
+	return db.blockWithReason("Block", root, "")
+}
+
+// BlockWithReason blocks root and the packages below it and records why the
+// root is blocked.
+func (db *Database) BlockWithReason(root, reason string) error {
+	return db.blockWithReason("BlockWithReason", root, reason)
+}
+
+func (db *Database) blockWithReason(name, root, reason string) error {
+	c := db.conn(name)
 	defer c.Close()
-	if _, err := c.Do("SADD", "block", root); err != nil {
+	c.Send("MULTI")
+	c.Send("SADD", "block", root)
+	if reason == "" {
+		c.Send("HDEL", "block:reasons", root)
+	} else {
+		c.Send("HSET", "block:reasons", root, reason)
+	}
+	if _, err := c.Do("EXEC"); err != nil {
 		return err
 	}
 	keys, err := redis.Strings(c.Do("HKEYS", "ids"))
@@ -660,6 +1499,57 @@ func (db *Database) Block(root string) error {
 	return nil
 }
 
+// Unblock removes root from the set of blocked project roots. Packages
+// deleted by Block are not restored; they are added back to the database
+// when next crawled.
+func (db *Database) Unblock(root string) error {
+	c := db.conn("Unblock")
+	defer c.Close()
+	c.Send("MULTI")
+	c.Send("SREM", "block", root)
+	c.Send("HDEL", "block:reasons", root)
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// Blocked returns the blocked project roots sorted alphabetically.
+func (db *Database) Blocked() ([]string, error) {
+	c := db.conn("Blocked")
+	defer c.Close()
+	roots, err := redis.Strings(c.Do("SMEMBERS", "block"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(roots)
+	return roots, nil
+}
+
+// BlockedReasons returns the blocked roots and the reasons they were
+// blocked. The reason is "" for roots blocked without one.
+func (db *Database) BlockedReasons() (map[string]string, error) {
+	c := db.conn("BlockedReasons")
+	defer c.Close()
+	c.Send("SMEMBERS", "block")
+	c.Send("HGETALL", "block:reasons")
+	values, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	roots, err := redis.Strings(values[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	reasons, err := redis.StringMap(values[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(roots))
+	for _, root := range roots {
+		result[root] = reasons[root]
+	}
+	return result, nil
+}
+
 var isBlockedScript = redis.NewScript(0, `
     local path = ''
     for s in string.gmatch(ARGV[1], '[^/]+') do
@@ -673,48 +1563,469 @@ var isBlockedScript = redis.NewScript(0, `
 `)
 
 func (db *Database) IsBlocked(path string) (bool, error) {
-	c := db.Pool.Get()
+	c := db.conn("IsBlocked")
 	defer c.Close()
 	return redis.Bool(isBlockedScript.Do(c, path))
 }
 
+// Ping checks that the Redis server is reachable.
+func (db *Database) Ping() error {
+	c := db.conn("Ping")
+	defer c.Close()
+	reply, err := redis.String(c.Do("PING"))
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("database: unexpected PING reply %q", reply)
+	}
+	return nil
+}
+
 func (db *Database) Query(q string) ([]Package, error) {
+	pkgs, _, err := db.queryPage("Query", q, 0, -1)
+	return pkgs, err
+}
+
+// QueryPage returns at most limit packages matching q starting at offset in
+// the result list. All packages from offset are returned if limit is
+// negative. The total number of matching packages is also returned.
+func (db *Database) QueryPage(q string, offset, limit int) ([]Package, int, error) {
+	return db.queryPage("QueryPage", q, offset, limit)
+}
+
+func (db *Database) queryPage(name, q string, offset, limit int) ([]Package, int, error) {
+	terms := parseQuery(q)
+	if len(terms) == 0 {
+		return nil, 0, nil
+	}
+	c := db.conn(name)
+	defer c.Close()
+	return db.query(c, q, terms, "score", offset, limit)
+}
+
+// QuerySorted is like Query, but sorts the results in the given order. The
+// order is "score", "path" or "popular".
+func (db *Database) QuerySorted(q string, order string) ([]Package, error) {
+	switch order {
+	case "score", "path", "popular":
+	default:
+		return nil, fmt.Errorf("database: unknown sort order %q", order)
+	}
 	terms := parseQuery(q)
 	if len(terms) == 0 {
 		return nil, nil
 	}
-	c := db.Pool.Get()
+	c := db.conn("QuerySorted")
 	defer c.Close()
+	pkgs, _, err := db.query(c, q, terms, order, 0, -1)
+	return pkgs, err
+}
+
+// sendIntersect sends the commands to store the intersection of the index
+// sets for terms at key id. The index sets for negated terms are subtracted
+// from the intersection. The function returns the keys to delete after the
+// query, including id, and the number of commands sent. The reply to the
+// last command is the size of the result.
+func sendIntersect(c redis.Conn, id string, terms []string) (keys []interface{}, n int) {
+	// Commands are indexed under command terms, except for the terms that
+	// do not depend on the kind of package. See documentTerms.
+	prefix := "index:"
+	for _, term := range terms {
+		if term == "kind:c" {
+			prefix += commandTermPrefix
+		}
+	}
+	key := func(term string) string {
+		if strings.HasPrefix(term, "kind:") || strings.HasPrefix(term, "project:") {
+			return "index:" + term
+		}
+		return prefix + term
+	}
+
+	keys = []interface{}{id}
+	args := []interface{}{id}
+	diff := []interface{}{id, id}
+	for _, term := range terms {
+		if strings.HasPrefix(term, "-") {
+			diff = append(diff, key(term[1:]))
+			continue
+		}
+		if strings.HasPrefix(term, "platform:") {
+			// Packages without specific files for the platform's dimension
+			// match the filter.
+			union := []interface{}{id + "-" + strconv.Itoa(len(keys)), key(term), key("platform:all")}
+			switch p := term[len("platform:"):]; {
+			case doc.IsKnownOS(p):
+				union = append(union, key("platform:allos"))
+			case doc.IsKnownArch(p):
+				union = append(union, key("platform:allarch"))
+			}
+			tmp := union[0]
+			c.Send("SUNIONSTORE", union...)
+			keys = append(keys, tmp)
+			args = append(args, tmp)
+			continue
+		}
+		args = append(args, key(term))
+	}
+	c.Send("SINTERSTORE", args...)
+	n = len(keys)
+	if len(diff) > 2 {
+		c.Send("SDIFFSTORE", diff...)
+		n++
+	}
+	return keys, n
+}
+
+// QueryCount returns the number of packages matching the query.
+func (db *Database) QueryCount(q string) (int, error) {
+	terms := parseQuery(q)
+	if len(terms) == 0 {
+		return 0, nil
+	}
+	c := db.conn("QueryCount")
+	defer c.Close()
+	terms, prefixes, err := scopeTerms(c, terms)
+	if err != nil {
+		return 0, err
+	}
+	if len(prefixes) > 0 {
+		pkgs, _, err := db.queryIndex(c, q, terms, "score", 0, -1)
+		return len(filterPrefixes(pkgs, prefixes)), err
+	}
 	n, err := redis.Int(c.Do("INCR", "maxQueryId"))
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	keys, sent := sendIntersect(c, "tmp:query-"+strconv.Itoa(n), terms)
+	c.Send("DEL", keys...)
+	values, err := redis.Values(c.Do(""))
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int(values[sent-1], nil)
+}
+
+// scopeTerms replaces the project: terms for roots that are not indexed with
+// path prefixes. Unlike the indexed project filter, which matches the
+// packages in one project, a prefix matches the packages in all projects
+// below the prefix, but the results must be fetched to filter by prefix.
+func scopeTerms(c redis.Conn, terms []string) ([]string, []string, error) {
+	var scoped, prefixes []string
+	positive := false
+	for _, term := range terms {
+		if strings.HasPrefix(term, "project:") {
+			exists, err := redis.Bool(c.Do("EXISTS", "index:"+term))
+			if err != nil {
+				return nil, nil, err
+			}
+			if !exists {
+				prefixes = append(prefixes, strings.TrimSuffix(term[len("project:"):], "/"))
+				continue
+			}
+		}
+		positive = positive || !strings.HasPrefix(term, "-")
+		scoped = append(scoped, term)
+	}
+	if !positive {
+		scoped = append([]string{"all:"}, scoped...)
+	}
+	return scoped, prefixes, nil
+}
+
+// filterPrefixes returns the packages with paths below all of the lower case
+// prefixes.
+func filterPrefixes(pkgs []Package, prefixes []string) []Package {
+	result := pkgs[:0]
+	for _, pkg := range pkgs {
+		path := strings.ToLower(pkg.Path)
+		ok := true
+		for _, prefix := range prefixes {
+			if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			result = append(result, pkg)
+		}
+	}
+	return result
+}
+
+func (db *Database) query(c redis.Conn, q string, terms []string, order string, offset, limit int) ([]Package, int, error) {
+	terms, prefixes, err := scopeTerms(c, terms)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(prefixes) == 0 {
+		return db.queryIndex(c, q, terms, order, offset, limit)
+	}
+	pkgs, _, err := db.queryIndex(c, q, terms, order, 0, -1)
+	if err != nil {
+		return nil, 0, err
+	}
+	pkgs = filterPrefixes(pkgs, prefixes)
+	total := len(pkgs)
+	if offset > len(pkgs) {
+		offset = len(pkgs)
+	}
+	pkgs = pkgs[offset:]
+	if limit >= 0 && limit < len(pkgs) {
+		pkgs = pkgs[:limit]
+	}
+	return pkgs, total, nil
+}
+
+func (db *Database) queryIndex(c redis.Conn, q string, terms []string, order string, offset, limit int) ([]Package, int, error) {
+	n, err := redis.Int(c.Do("INCR", "maxQueryId"))
+	if err != nil {
+		return nil, 0, err
 	}
 	id := "tmp:query-" + strconv.Itoa(n)
 
+	tmps, sent := sendIntersect(c, id, terms)
+	ntotal := sent - 1
 	args := []interface{}{id}
+	switch order {
+	case "path":
+		args = append(args, "ALPHA", "BY", "pkg:*->path")
+	case "popular":
+		// Packages without a popular score sort last with a score of zero.
+		// The scores are negated so that the ascending zset order is most
+		// popular first.
+		pop := id + ":popular"
+		c.Send("ZINTERSTORE", pop, 2, id, "popular", "WEIGHTS", 0, -1)
+		c.Send("ZUNIONSTORE", pop, 2, pop, id, "WEIGHTS", 1, 0)
+		tmps = append(tmps, pop)
+		args = []interface{}{pop, "BY", "nosort"}
+	default:
+		var words []string
+		for _, term := range terms {
+			if strings.Index(term, ":") < 0 && !strings.HasPrefix(term, "-") {
+				words = append(words, term)
+			}
+		}
+		if len(words) == 0 {
+			args = append(args, "DESC", "BY", "pkg:*->score")
+			break
+		}
+		// The rank of a package is its score plus the weight:<term> scores
+		// of the query words that it matches. Packages without a score
+		// rank last. The ranks are negated so that the ascending zset order
+		// is best first.
+		rank := id + ":rank"
+		c.Send("ZINTERSTORE", rank, 2, id, "score", "WEIGHTS", 0, -1)
+		keys := []interface{}{rank, 2 + len(words), rank, id}
+		weights := []interface{}{"WEIGHTS", 1, 0}
+		for _, w := range words {
+			keys = append(keys, "weight:"+w)
+			weights = append(weights, -1)
+		}
+		c.Send("ZUNIONSTORE", append(keys, weights...)...)
+		c.Send("ZINTERSTORE", rank, 2, rank, id, "WEIGHTS", 1, 0)
+		tmps = append(tmps, rank)
+		args = []interface{}{rank, "BY", "nosort"}
+	}
+	args = append(args, "LIMIT", offset, limit, "GET", "pkg:*->path", "GET", "pkg:*->synopsis", "GET", "pkg:*->kind", "GET", "pkg:*->deprecated")
+	c.Send("SORT", args...)
+	c.Send("DEL", tmps...)
+	values, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := redis.Int(values[ntotal], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	pkgs, err := packages(values[len(values)-2], false, true)
+
+	// Move exact match on standard package to the top of the list.
+	if offset == 0 && order == "score" {
+		for i, pkg := range pkgs {
+			if !isStandardPackage(pkg.Path) {
+				break
+			}
+			if strings.HasSuffix(pkg.Path, q) {
+				pkgs[0], pkgs[i] = pkgs[i], pkgs[0]
+				break
+			}
+		}
+	}
+	return pkgs, total, err
+}
+
+// correctTerms returns a map from the query terms not in the index to a
+// replacement term in the index. Replacements are found among the terms with
+// the same two byte prefix at an edit distance of one. The replacement
+// matching the most packages is used.
+func correctTerms(c redis.Conn, terms []string) (map[string]string, error) {
+	var candidates []string
 	for _, term := range terms {
-		args = append(args, "index:"+term)
+		if strings.Contains(term, ":") || len(term) < 2 {
+			continue
+		}
+		c.Send("EXISTS", "index:"+term)
+		c.Send("SMEMBERS", "terms:"+term[:2])
+		candidates = append(candidates, term)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
 	}
-	c.Send("SINTERSTORE", args...)
-	c.Send("SORT", id, "DESC", "BY", "pkg:*->score", "GET", "pkg:*->path", "GET", "pkg:*->synopsis", "GET", "pkg:*->kind")
-	c.Send("DEL", id)
 	values, err := redis.Values(c.Do(""))
 	if err != nil {
 		return nil, err
 	}
-	pkgs, err := packages(values[1], false)
 
-	// Move exact match on standard package to the top of the list.
-	for i, pkg := range pkgs {
-		if !isStandardPackage(pkg.Path) {
-			break
+	var edits [][2]string
+	for i, term := range candidates {
+		if exists, _ := redis.Bool(values[2*i], nil); exists {
+			continue
 		}
-		if strings.HasSuffix(pkg.Path, q) {
-			pkgs[0], pkgs[i] = pkgs[i], pkgs[0]
-			break
+		known, err := redis.Strings(values[2*i+1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range known {
+			if isOneEdit(term, k) {
+				c.Send("SCARD", "index:"+k)
+				edits = append(edits, [2]string{term, k})
+			}
 		}
 	}
-	return pkgs, err
+	if len(edits) == 0 {
+		return nil, nil
+	}
+	counts, err := redis.Ints(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+
+	corrections := make(map[string]string)
+	best := make(map[string]int)
+	for i, edit := range edits {
+		if counts[i] > best[edit[0]] {
+			best[edit[0]] = counts[i]
+			corrections[edit[0]] = edit[1]
+		}
+	}
+	return corrections, nil
+}
+
+// QueryWithCorrection returns the packages matching q. If no packages match
+// and corrections are found for misspelled query terms, then the packages
+// matching the corrected query and the corrected query are returned. The
+// returned query is "" if no correction was made. Corrections are found in
+// the terms:<prefix> sets maintained by Put and Reindex, so a database with
+// packages stored before these sets were added must be reindexed.
+func (db *Database) QueryWithCorrection(q string) ([]Package, string, error) {
+	terms := parseQuery(q)
+	if len(terms) == 0 {
+		return nil, "", nil
+	}
+	c := db.conn("QueryWithCorrection")
+	defer c.Close()
+	pkgs, _, err := db.query(c, q, terms, "score", 0, -1)
+	if err != nil || len(pkgs) > 0 {
+		return pkgs, "", err
+	}
+
+	corrections, err := correctTerms(c, terms)
+	if err != nil || len(corrections) == 0 {
+		return nil, "", err
+	}
+	for i, term := range terms {
+		if t, ok := corrections[term]; ok {
+			terms[i] = t
+		}
+	}
+	corrected := replaceWords(q, func(w string) string {
+		if t, ok := corrections[stem(strings.ToLower(w))]; ok {
+			return correctWord(w, t)
+		}
+		return w
+	})
+	pkgs, _, err = db.query(c, corrected, terms, "score", 0, -1)
+	if err != nil {
+		return nil, "", err
+	}
+	return pkgs, corrected, nil
+}
+
+// PackageSnippet is a search result with the query words highlighted in the
+// synopsis.
+type PackageSnippet struct {
+	Package
+
+	// Highlight is the HTML escaped synopsis with the words matching the
+	// query wrapped in <mark> elements.
+	Highlight string `json:"highlight,omitempty"`
+}
+
+// QueryWithSnippets is like Query, but returns each package with a snippet
+// of the synopsis that highlights the words matching q.
+func (db *Database) QueryWithSnippets(q string) ([]PackageSnippet, error) {
+	terms := parseQuery(q)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	c := db.conn("QueryWithSnippets")
+	defer c.Close()
+	pkgs, _, err := db.query(c, q, terms, "score", 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	stems := highlightStems(terms)
+	result := make([]PackageSnippet, len(pkgs))
+	for i, pkg := range pkgs {
+		result[i].Package = pkg
+		result[i].Highlight = highlight(pkg.Synopsis, stems)
+	}
+	return result, nil
+}
+
+var suggestScript = redis.NewScript(0, `
+    local prefix = ARGV[1]
+    local bucket = ARGV[2]
+    local count = tonumber(ARGV[3])
+    local ids = redis.call('SORT', 'index:suggest:' .. bucket, 'DESC', 'BY', 'pkg:*->score')
+    local result = {}
+    for i=1,#ids do
+        local values = redis.call('HMGET', 'pkg:' .. ids[i], 'path', 'synopsis', 'kind')
+        local base = string.lower(string.match(values[1], '[^/]*$'))
+        if string.sub(base, 1, #prefix) == prefix then
+            result[#result+1] = values[1]
+            result[#result+1] = values[2]
+            result[#result+1] = values[3]
+            if #result >= 3 * count then
+                break
+            end
+        end
+    end
+    return result
+`)
+
+const maxSuggestions = 10
+
+// Suggest returns the highest scoring packages with last path element
+// starting with prefix. At least two characters are required.
+func (db *Database) Suggest(prefix string) ([]Package, error) {
+	prefix = strings.ToLower(prefix)
+	var bucket string
+	for n := maxSuggestPrefix; n >= minSuggestPrefix && bucket == ""; n-- {
+		bucket = suggestPrefix(prefix, n)
+	}
+	if bucket == "" {
+		return nil, nil
+	}
+	c := db.conn("Suggest")
+	defer c.Close()
+	reply, err := suggestScript.Do(c, prefix, bucket, maxSuggestions)
+	if err != nil {
+		return nil, err
+	}
+	return packages(reply, false, false)
 }
 
 type PackageInfo struct {
@@ -725,55 +2036,253 @@ type PackageInfo struct {
 	Size  int
 }
 
-// Do executes function f for each document in the database.
-func (db *Database) Do(f func(*PackageInfo) error) error {
-	c := db.Pool.Get()
+var reindexScript = redis.NewScript(0, updateWeightsLua+`
+    local id = ARGV[1]
+    local score = ARGV[2]
+    local terms = ARGV[3]
+    local weights = ARGV[4]
+
+    local etag = redis.call('HGET', 'pkg:' .. id, 'etag')
+    if etag and etag ~= '' and etag == redis.call('HGET', 'pkg:' .. id, 'clone') then
+        terms = ''
+        score = 0
+        weights = ''
+    end
+
+    local update = {}
+    for term in string.gmatch(redis.call('HGET', 'pkg:' .. id, 'terms') or '', '([^ ]+)') do
+        update[term] = 1
+    end
+
+    for term in string.gmatch(terms, '([^ ]+)') do
+        update[term] = (update[term] or 0) + 2
+    end
+
+    for term, x in pairs(update) do
+        if x == 1 then
+            redis.call('SREM', 'index:' .. term, id)
+            if not string.find(term, ':', 1, true) and redis.call('SCARD', 'index:' .. term) == 0 then
+                redis.call('SREM', 'terms:' .. string.sub(term, 1, 2), term)
+            end
+        else
+            if x == 2 then
+                redis.call('SADD', 'index:' .. term, id)
+            end
+            if not string.find(term, ':', 1, true) then
+                redis.call('SADD', 'terms:' .. string.sub(term, 1, 2), term)
+            end
+        end
+    end
+
+    updateWeights(id, score, weights)
+
+    return redis.call('HMSET', 'pkg:' .. id, 'score', score, 'terms', terms, 'weights', weights)
+`)
+
+// Reindex recomputes the search score, terms and term weights of every package from the
+// stored documentation. The crawl schedule and etags are not changed.
+func (db *Database) Reindex() error {
+	c := db.conn("Reindex")
 	defer c.Close()
-	keys, err := redis.Values(c.Do("KEYS", "pkg:*"))
-	if err != nil {
-		return err
-	}
-	for _, key := range keys {
-		values, err := redis.Values(c.Do("HMGET", key, "gob", "score", "kind", "path", "terms", "synopis"))
-		if err != nil {
-			return err
+	return scanPackageKeys(c, func(keys []string) error {
+		for _, key := range keys {
+			values, err := redis.Values(c.Do("HMGET", key, "gob", "path"))
+			if err != nil {
+				return err
+			}
+			var (
+				p    []byte
+				path string
+			)
+			if _, err := redis.Scan(values, &p, &path); err != nil {
+				return err
+			}
+			if p == nil {
+				continue
+			}
+			pdoc, err := decodeDoc(path, p)
+			if err != nil {
+				return err
+			}
+			score := documentScore(pdoc)
+			terms := documentTerms(pdoc, score)
+			if _, err := reindexScript.Do(c, key[len("pkg:"):], score, strings.Join(terms, " "), formatWeights(documentTermWeights(pdoc, score))); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+}
 
-		var (
-			pi       PackageInfo
-			p        []byte
-			path     string
-			terms    string
-			synopsis string
-		)
+// scanPackageKeys calls scanKeys with the pkg:<id> hash keys. The keys of
+// stored versions are skipped.
+func scanPackageKeys(c redis.Conn, f func(keys []string) error) error {
+	return scanKeys(c, "pkg:*", func(keys []string) error {
+		pkeys := keys[:0]
+		for _, key := range keys {
+			if strings.Count(key, ":") == 1 {
+				pkeys = append(pkeys, key)
+			}
+		}
+		return f(pkeys)
+	})
+}
 
-		if _, err := redis.Scan(values, &p, &pi.Score, &pi.Kind, &path, &terms, &synopsis); err != nil {
+// scanKeys calls f with each batch of keys matching pattern returned by
+// SCAN. A key returned more than once by SCAN is passed to f once.
+func scanKeys(c redis.Conn, pattern string, f func(keys []string) error) error {
+	seen := make(map[string]bool)
+	cursor := 0
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
 			return err
 		}
-
-		if p == nil {
-			continue
+		keys, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return err
+		}
+		cursor, err = redis.Int(values[0], nil)
+		if err != nil {
+			return err
+		}
+		var batch []string
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				batch = append(batch, key)
+			}
+		}
+		if len(batch) > 0 {
+			if err := f(batch); err != nil {
+				return err
+			}
 		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// Do executes function f for each document in the database.
+func (db *Database) Do(f func(*PackageInfo) error) error {
+	_, err := db.do("Do", f, false)
+	return err
+}
 
-		pi.Size = len(path) + len(p) + len(terms) + len(synopsis)
+// DoSkipCorrupt executes function f for each document in the database.
+// Documents that cannot be decoded are logged and skipped instead of
+// stopping the iteration. The number of skipped documents is returned.
+func (db *Database) DoSkipCorrupt(f func(*PackageInfo) error) (int, error) {
+	return db.do("DoSkipCorrupt", f, true)
+}
 
-		p, err = snappy.Decode(nil, p)
-		if err != nil {
-			return fmt.Errorf("snappy decoding %s: %v", path, err)
+func (db *Database) do(name string, f func(*PackageInfo) error, skipCorrupt bool) (int, error) {
+	c := db.conn(name)
+	defer c.Close()
+	skipped := 0
+	err := scanPackageKeys(c, func(keys []string) error {
+		for _, key := range keys {
+			values, err := redis.Values(c.Do("HMGET", key, "gob", "score", "kind", "path", "terms", "synopsis"))
+			if err != nil {
+				return err
+			}
+
+			var (
+				pi       PackageInfo
+				p        []byte
+				path     string
+				terms    string
+				synopsis string
+			)
+
+			if _, err := redis.Scan(values, &p, &pi.Score, &pi.Kind, &path, &terms, &synopsis); err != nil {
+				return err
+			}
+
+			if p == nil {
+				continue
+			}
+
+			pi.Size = len(path) + len(p) + len(terms) + len(synopsis)
+
+			pi.PDoc, err = decodeDoc(path, p)
+			if err != nil {
+				if skipCorrupt {
+					log.Printf("Skipping: %v", err)
+					skipped++
+					continue
+				}
+				return err
+			}
+			pi.Pkgs, err = db.getSubdirs(c, pi.PDoc.ImportPath, pi.PDoc, false)
+			if err != nil {
+				return fmt.Errorf("get subdirs %s: %v", path, err)
+			}
+			if err := f(&pi); err != nil {
+				return fmt.Errorf("func %s: %v", path, err)
+			}
 		}
+		return nil
+	})
+	return skipped, err
+}
+
+// Stats is a summary of the database contents.
+type Stats struct {
+	Packages  int            // number of import paths
+	Kinds     map[string]int // number of packages by kind: p, c or d
+	NewCrawl  int            // size of the new crawl set
+	BadCrawl  int            // size of the bad crawl set
+	NextCrawl int            // length of the crawl queue
+	Size      int            // bytes stored for packages, as in PackageInfo.Size
+}
+
+// Stats returns statistics for the database. The package hashes are read
+// with SCAN, so the counts can be inconsistent if the database is modified
+// during the call.
+func (db *Database) Stats() (*Stats, error) {
+	c := db.conn("Stats")
+	defer c.Close()
+
+	c.Send("HLEN", "ids")
+	c.Send("SCARD", "newCrawl")
+	c.Send("SCARD", "badCrawl")
+	c.Send("ZCARD", "nextCrawl")
+	values, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	stats := &Stats{Kinds: make(map[string]int)}
+	if _, err := redis.Scan(values, &stats.Packages, &stats.NewCrawl, &stats.BadCrawl, &stats.NextCrawl); err != nil {
+		return nil, err
+	}
 
-		if err := gob.NewDecoder(bytes.NewReader(p)).Decode(&pi.PDoc); err != nil {
-			return fmt.Errorf("gob decoding %s: %v", path, err)
+	err = scanPackageKeys(c, func(keys []string) error {
+		for _, key := range keys {
+			c.Send("HMGET", key, "kind", "path", "gob", "terms", "synopsis")
 		}
-		pi.Pkgs, err = db.getSubdirs(c, pi.PDoc.ImportPath, pi.PDoc)
-		if err != nil {
-			return fmt.Errorf("get subdirs %s: %v", path, err)
+		if err := c.Flush(); err != nil {
+			return err
 		}
-		if err := f(&pi); err != nil {
-			return fmt.Errorf("func %s: %v", path, err)
+		for range keys {
+			values, err := redis.Values(c.Receive())
+			if err != nil {
+				return err
+			}
+			var kind, path, p, terms, synopsis []byte
+			if _, err := redis.Scan(values, &kind, &path, &p, &terms, &synopsis); err != nil {
+				return err
+			}
+			stats.Kinds[string(kind)]++
+			stats.Size += len(path) + len(p) + len(terms) + len(synopsis)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return stats, nil
 }
 
 var importGraphScript = redis.NewScript(0, `
@@ -787,28 +2296,46 @@ var importGraphScript = redis.NewScript(0, `
     return redis.call('HMGET', 'pkg:' .. id, 'synopsis', 'terms')
 `)
 
-func (db *Database) ImportGraph(pdoc *doc.Package, hideStdDeps bool) ([]Package, [][2]int, error) {
+// ImportGraph returns the nodes and edges of the package's dependency graph.
+// Nodes more than maxDepth edges from the root are not expanded if maxDepth
+// is greater than zero. If includeTests is true, then the test imports of the
+// root package are also included. The returned []bool reports whether the
+// corresponding edge is a test import.
+func (db *Database) ImportGraph(pdoc *doc.Package, hideStdDeps bool, maxDepth int, includeTests bool) ([]Package, [][2]int, []bool, error) {
 
 	// This breadth-first traversal of the package's dependencies uses the
 	// Redis pipeline as queue. Links to packages with invalid import paths are
 	// only included for the root package.
 
-	c := db.Pool.Get()
+	c := db.conn("ImportGraph")
 	defer c.Close()
 	if err := importGraphScript.Load(c); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	nodes := []Package{{Path: pdoc.ImportPath, Synopsis: pdoc.Synopsis}}
+	depths := []int{0}
 	edges := [][2]int{}
+	testEdges := []bool{}
 	index := map[string]int{pdoc.ImportPath: 0}
 
-	for _, path := range pdoc.Imports {
-		j := len(nodes)
-		index[path] = j
-		edges = append(edges, [2]int{0, j})
-		nodes = append(nodes, Package{Path: path})
-		importGraphScript.Send(c, path)
+	rootImports := [][]string{pdoc.Imports}
+	if includeTests {
+		rootImports = append(rootImports, pdoc.TestImports, pdoc.XTestImports)
+	}
+	for k, paths := range rootImports {
+		for _, path := range paths {
+			if _, ok := index[path]; ok {
+				continue
+			}
+			j := len(nodes)
+			index[path] = j
+			edges = append(edges, [2]int{0, j})
+			testEdges = append(testEdges, k > 0)
+			nodes = append(nodes, Package{Path: path})
+			depths = append(depths, 1)
+			importGraphScript.Send(c, path)
+		}
 	}
 
 	for i := 1; i < len(nodes); i++ {
@@ -817,16 +2344,19 @@ func (db *Database) ImportGraph(pdoc *doc.Package, hideStdDeps bool) ([]Package,
 		if err == redis.ErrNil {
 			continue
 		} else if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		var synopsis, terms string
 		if _, err := redis.Scan(r, &synopsis, &terms); err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		nodes[i].Synopsis = synopsis
 		if hideStdDeps && isStandardPackage(nodes[i].Path) {
 			continue
 		}
+		if maxDepth > 0 && depths[i] >= maxDepth {
+			continue
+		}
 		for _, term := range strings.Fields(terms) {
 			if strings.HasPrefix(term, "import:") {
 				path := term[len("import:"):]
@@ -835,28 +2365,145 @@ func (db *Database) ImportGraph(pdoc *doc.Package, hideStdDeps bool) ([]Package,
 					j = len(nodes)
 					index[path] = j
 					nodes = append(nodes, Package{Path: path})
+					depths = append(depths, depths[i]+1)
 					importGraphScript.Send(c, path)
 				}
 				edges = append(edges, [2]int{i, j})
+				testEdges = append(testEdges, false)
+			}
+		}
+	}
+	return nodes, edges, testEdges, nil
+}
+
+const defaultReverseImportDepth = 2
+
+// ReverseImportGraph returns the nodes and edges of the graph of packages that
+// directly or indirectly import the package. The graph includes packages at
+// most maxDepth edges from the root. A default depth is used if maxDepth is
+// not greater than zero. As in ImportGraph, the edge {i, j} specifies that
+// nodes[i] imports nodes[j].
+func (db *Database) ReverseImportGraph(pdoc *doc.Package, maxDepth int) ([]Package, [][2]int, error) {
+	if maxDepth <= 0 {
+		maxDepth = defaultReverseImportDepth
+	}
+
+	// As in ImportGraph, the Redis pipeline is used as the queue for the
+	// breadth-first traversal.
+
+	c := db.conn("ReverseImportGraph")
+	defer c.Close()
+
+	sendImporters := func(path string) {
+		c.Send("SORT", "index:import:"+path, "ALPHA", "BY", "pkg:*->path", "GET", "pkg:*->path", "GET", "pkg:*->synopsis", "GET", "pkg:*->kind")
+	}
+
+	nodes := []Package{{Path: pdoc.ImportPath, Synopsis: pdoc.Synopsis}}
+	depths := []int{0}
+	edges := [][2]int{}
+	index := map[string]int{pdoc.ImportPath: 0}
+	sendImporters(pdoc.ImportPath)
+
+	// Nodes are appended in order of depth. Stop at the first node that is
+	// not expanded.
+	for i := 0; i < len(nodes) && depths[i] < maxDepth; i++ {
+		c.Flush()
+		reply, err := c.Receive()
+		if err != nil {
+			return nil, nil, err
+		}
+		pkgs, err := packages(reply, false, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, pkg := range pkgs {
+			j, ok := index[pkg.Path]
+			if !ok {
+				j = len(nodes)
+				index[pkg.Path] = j
+				nodes = append(nodes, pkg)
+				depths = append(depths, depths[i]+1)
+				if depths[j] < maxDepth {
+					sendImporters(pkg.Path)
+				}
 			}
+			edges = append(edges, [2]int{j, i})
 		}
 	}
 	return nodes, edges, nil
 }
 
+// ImportGraphJSON returns the import graph computed by ImportGraph as a JSON
+// object with the fields nodes and edges. The root is nodes[0] and the edge
+// [i, j] specifies that nodes[i] imports nodes[j].
+func (db *Database) ImportGraphJSON(pdoc *doc.Package, hideStdDeps bool) ([]byte, error) {
+	nodes, edges, _, err := db.ImportGraph(pdoc, hideStdDeps, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		Nodes []Package `json:"nodes"`
+		Edges [][2]int  `json:"edges"`
+	}{nodes, edges})
+}
+
+// dotQuote returns s as a quoted GraphViz string.
+func dotQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return `"` + s + `"`
+}
+
+// ImportGraphDOT returns the graph returned by ImportGraph or
+// ReverseImportGraph as a GraphViz digraph. The root, nodes[0], is filled.
+// Standard packages other than the root are grouped in a cluster.
+func ImportGraphDOT(nodes []Package, edges [][2]int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("digraph G {\n")
+	writeNode := func(indent string, i int) {
+		fmt.Fprintf(&buf, "%sn%d [label=%s, URL=%s, tooltip=%s", indent, i,
+			dotQuote(nodes[i].Path), dotQuote("/"+nodes[i].Path), dotQuote(nodes[i].Synopsis))
+		if i == 0 {
+			buf.WriteString(", style=filled, fillcolor=lightgray")
+		}
+		buf.WriteString("];\n")
+	}
+	var std []int
+	for i := range nodes {
+		if i > 0 && isStandardPackage(nodes[i].Path) {
+			std = append(std, i)
+		} else {
+			writeNode(" ", i)
+		}
+	}
+	if len(std) > 0 {
+		buf.WriteString(" subgraph cluster_std {\n  label=\"standard library\";\n")
+		for _, i := range std {
+			writeNode("  ", i)
+		}
+		buf.WriteString(" }\n")
+	}
+	for _, edge := range edges {
+		fmt.Fprintf(&buf, " n%d -> n%d;\n", edge[0], edge[1])
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
 func (db *Database) PutGob(key string, value interface{}) error {
 	var buf bytes.Buffer
 	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
 		return err
 	}
-	c := db.Pool.Get()
+	c := db.conn("PutGob")
 	defer c.Close()
 	_, err := c.Do("SET", "gob:"+key, buf.Bytes())
 	return err
 }
 
 func (db *Database) GetGob(key string, value interface{}) error {
-	c := db.Pool.Get()
+	c := db.conn("GetGob")
 	defer c.Close()
 	p, err := redis.Bytes(c.Do("GET", "gob:"+key))
 	if err == redis.ErrNil {
@@ -867,36 +2514,73 @@ func (db *Database) GetGob(key string, value interface{}) error {
 	return gob.NewDecoder(bytes.NewReader(p)).Decode(value)
 }
 
-var incrementPopularScoreScript = redis.NewScript(0, `
+// decayLua is prepended to the scripts that read or update decayed values.
+const decayLua = `
+    -- decay returns the value at scaled time t of the value n recorded at
+    -- scaled time t0.
+    local function decay(n, t0, t)
+        return n * math.exp(t0 - t)
+    end
+`
+
+var incrementPopularScoreScript = redis.NewScript(0, decayLua+`
     local path = ARGV[1]
     local n = ARGV[2]
-    local t = ARGV[3]
 
     local id = redis.call('HGET', 'ids', path)
     if not id then
         return
     end
 
-    local t0 = redis.call('GET', 'popular:0') or '0'
-    local f = math.exp(tonumber(t) - tonumber(t0))
-    redis.call('ZINCRBY', 'popular', tonumber(n) * f, id)
-    if f > 10 then
-        redis.call('SET', 'popular:0', t)
-        redis.call('ZUNIONSTORE', 'popular', 1, 'popular', 'WEIGHTS', 1.0 / f)
-        redis.call('ZREMRANGEBYSCORE', 'popular', '-inf', 0.05)
+    for i=3,#ARGV,2 do
+        local key = ARGV[i]
+        local t = ARGV[i+1]
+        local t0 = redis.call('GET', key .. ':0')
+        if not t0 then
+            -- Start at the current time to avoid overflow in math.exp.
+            redis.call('SET', key .. ':0', t)
+            t0 = t
+        end
+        local f = 1 / decay(1, tonumber(t0), tonumber(t))
+        redis.call('ZINCRBY', key, tonumber(n) * f, id)
+        if f > 10 then
+            redis.call('SET', key .. ':0', t)
+            redis.call('ZUNIONSTORE', key, 1, key, 'WEIGHTS', 1.0 / f)
+            redis.call('ZREMRANGEBYSCORE', key, '-inf', 0.05)
+        end
     end
 `)
 
 const popularHalfLife = time.Hour * 24 * 7
 
-func (db *Database) incrementPopularScoreInternal(path string, delta float64, t time.Time) error {
+// popularWindows are the half lives and zset keys for the popular scores.
+// The scaled base time for a zset is stored at the zset key + ":0".
+var popularWindows = []struct {
+	halfLife time.Duration
+	key      string
+}{
+	{popularHalfLife, "popular"},
+	{time.Hour * 24, "popular:day"},
+}
+
+// scaledTime returns t scaled for computing exponential decay with the
+// given half life. The decay function in decayLua computes the value at a
+// scaled time.
+func scaledTime(t time.Time, halfLife time.Duration) float64 {
 	// nt = n0 * math.Exp(-lambda * t)
 	// lambda = math.Ln2 / thalf
-	c := db.Pool.Get()
+	lambda := math.Ln2 / float64(halfLife)
+	return lambda * float64(t.Sub(time.Unix(1257894000, 0)))
+}
+
+func (db *Database) incrementPopularScoreInternal(path string, delta float64, t time.Time) error {
+	c := db.conn("IncrementPopularScore")
 	defer c.Close()
-	const lambda = math.Ln2 / float64(popularHalfLife)
-	scaledTime := lambda * float64(t.Sub(time.Unix(1257894000, 0)))
-	_, err := incrementPopularScoreScript.Do(c, path, delta, scaledTime)
+	args := []interface{}{path, delta}
+	for _, w := range popularWindows {
+		args = append(args, w.key, scaledTime(t, w.halfLife))
+	}
+	_, err := incrementPopularScoreScript.Do(c, args...)
 	return err
 }
 
@@ -905,8 +2589,9 @@ func (db *Database) IncrementPopularScore(path string) error {
 }
 
 var popularScript = redis.NewScript(0, `
-    local stop = ARGV[1]
-    local ids = redis.call('ZREVRANGE', 'popular', '0', stop)
+    local key = ARGV[1]
+    local stop = ARGV[2]
+    local ids = redis.call('ZREVRANGE', key, '0', stop)
     local result = {}
     for i=1,#ids do
         local values = redis.call('HMGET', 'pkg:' .. ids[i], 'path', 'synopsis', 'kind')
@@ -918,16 +2603,78 @@ var popularScript = redis.NewScript(0, `
 `)
 
 func (db *Database) Popular(count int) ([]Package, error) {
-	c := db.Pool.Get()
+	return db.popularWindow("Popular", popularHalfLife, count)
+}
+
+// PopularWindow returns the most popular packages using the popular scores
+// with the half life closest to window.
+func (db *Database) PopularWindow(window time.Duration, count int) ([]Package, error) {
+	return db.popularWindow("PopularWindow", window, count)
+}
+
+func (db *Database) popularWindow(name string, window time.Duration, count int) ([]Package, error) {
+	key := popularWindows[0].key
+	best := time.Duration(math.MaxInt64)
+	for _, w := range popularWindows {
+		d := w.halfLife - window
+		if d < 0 {
+			d = -d
+		}
+		if d < best {
+			key, best = w.key, d
+		}
+	}
+
+	c := db.conn(name)
 	defer c.Close()
-	reply, err := popularScript.Do(c, count-1)
+	reply, err := popularScript.Do(c, key, count-1)
 	if err != nil {
 		return nil, err
 	}
-	pkgs, err := packages(reply, false)
+	pkgs, err := packages(reply, false, false)
 	return pkgs, err
 }
 
+var resetPopularScoreScript = redis.NewScript(0, `
+    local id = redis.call('HGET', 'ids', ARGV[1])
+    if not id then
+        return
+    end
+    for i=2,#ARGV do
+        redis.call('ZREM', ARGV[i], id)
+    end
+`)
+
+// ResetPopularScore removes the popular scores for the given import path.
+func (db *Database) ResetPopularScore(path string) error {
+	args := []interface{}{path}
+	for _, w := range popularWindows {
+		args = append(args, w.key)
+	}
+	c := db.conn("ResetPopularScore")
+	defer c.Close()
+	_, err := resetPopularScoreScript.Do(c, args...)
+	return err
+}
+
+var resetAllPopularScoresScript = redis.NewScript(0, `
+    for i=1,#ARGV do
+        redis.call('DEL', ARGV[i], ARGV[i] .. ':0')
+    end
+`)
+
+// ResetAllPopularScores removes the popular scores for all packages.
+func (db *Database) ResetAllPopularScores() error {
+	var args []interface{}
+	for _, w := range popularWindows {
+		args = append(args, w.key)
+	}
+	c := db.conn("ResetAllPopularScores")
+	defer c.Close()
+	_, err := resetAllPopularScoresScript.Do(c, args...)
+	return err
+}
+
 var popularWithScoreScript = redis.NewScript(0, `
     local ids = redis.call('ZREVRANGE', 'popular', '0', -1, 'WITHSCORES')
     local result = {}
@@ -940,18 +2687,42 @@ var popularWithScoreScript = redis.NewScript(0, `
 `)
 
 func (db *Database) PopularWithScores() ([]Package, error) {
-	c := db.Pool.Get()
+	c := db.conn("PopularWithScores")
 	defer c.Close()
 	reply, err := popularWithScoreScript.Do(c)
 	if err != nil {
 		return nil, err
 	}
-	pkgs, err := packages(reply, false)
+	pkgs, err := packages(reply, false, false)
 	return pkgs, err
 }
 
+var popularScoreScript = redis.NewScript(0, decayLua+`
+    local id = redis.call('HGET', 'ids', ARGV[1])
+    if not id then
+        return '0'
+    end
+    local n = redis.call('ZSCORE', 'popular', id)
+    if not n then
+        return '0'
+    end
+    return tostring(decay(tonumber(n), tonumber(redis.call('GET', 'popular:0') or 0), tonumber(ARGV[2])))
+`)
+
+// PopularScore returns the current popular score of a package, or zero if
+// the package does not have a popular score.
+func (db *Database) PopularScore(path string) (float64, error) {
+	return db.popularScoreInternal(path, time.Now())
+}
+
+func (db *Database) popularScoreInternal(path string, t time.Time) (float64, error) {
+	c := db.conn("PopularScore")
+	defer c.Close()
+	return redis.Float64(popularScoreScript.Do(c, path, scaledTime(t, popularHalfLife)))
+}
+
 func (db *Database) PopNewCrawl() (string, bool, error) {
-	c := db.Pool.Get()
+	c := db.conn("PopNewCrawl")
 	defer c.Close()
 
 	var subdirs []Package
@@ -962,19 +2733,113 @@ func (db *Database) PopNewCrawl() (string, bool, error) {
 		err = nil
 		path = ""
 	case err == nil:
-		subdirs, err = db.getSubdirs(c, path, nil)
+		subdirs, err = db.getSubdirs(c, path, nil, false)
 	}
 	return path, len(subdirs) > 0, err
 }
 
+var claimNextCrawlScript = redis.NewScript(0, `
+    local now = tonumber(ARGV[1])
+    local t = ARGV[2]
+
+    local next = redis.call('ZRANGE', 'nextCrawl', 0, 0, 'WITHSCORES')
+    if #next == 0 or tonumber(next[2]) > now then
+        return false
+    end
+
+    local id = next[1]
+    redis.call('ZADD', 'nextCrawl', t, id)
+    redis.call('HSET', 'pkg:' .. id, 'crawl', t)
+    return redis.call('HGET', 'pkg:' .. id, 'path')
+`)
+
+// ClaimNextCrawl returns the path of the package that is most overdue for a
+// crawl and reschedules the package to lease from now so that other workers
+// do not claim it while it is crawled. The returned path is "" if no package
+// is due.
+func (db *Database) ClaimNextCrawl(lease time.Duration) (string, error) {
+	c := db.conn("ClaimNextCrawl")
+	defer c.Close()
+	now := time.Now()
+	path, err := redis.String(claimNextCrawlScript.Do(c, now.Unix(), now.Add(lease).Unix()))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return path, err
+}
+
 func (db *Database) AddBadCrawl(path string) error {
-	c := db.Pool.Get()
+	c := db.conn("AddBadCrawl")
 	defer c.Close()
 	_, err := c.Do("SADD", "badCrawl", path)
 	return err
 }
 
-var incrementCounterScript = redis.NewScript(0, `
+var retryBadCrawlsScript = redis.NewScript(0, `
+    local n = 0
+    local pkgs = redis.call('SMEMBERS', 'badCrawl')
+    for i=1,#pkgs do
+        local pkg = pkgs[i]
+        if redis.call('HEXISTS', 'ids',  pkg) == 0 and redis.call('EXISTS', 'tombstone:' .. pkg) == 0 then
+            redis.call('SADD', 'newCrawl', pkg)
+            n = n + 1
+        end
+    end
+    redis.call('DEL', 'badCrawl')
+    return n
+`)
+
+// RetryBadCrawls moves the paths in the bad crawl set to the new crawl set
+// and returns the number of paths moved. Stored and tombstoned paths are
+// dropped from the bad crawl set without being moved.
+func (db *Database) RetryBadCrawls() (int, error) {
+	c := db.conn("RetryBadCrawls")
+	defer c.Close()
+	return redis.Int(retryBadCrawlsScript.Do(c))
+}
+
+// BadCrawlCount returns the number of paths in the bad crawl set.
+func (db *Database) BadCrawlCount() (int, error) {
+	c := db.conn("BadCrawlCount")
+	defer c.Close()
+	return redis.Int(c.Do("SCARD", "badCrawl"))
+}
+
+type CrawlStats struct {
+	NewCrawl  int       // size of the new crawl set
+	NextCrawl int       // length of the crawl queue
+	Overdue   int       // packages in the crawl queue that are due
+	Next      time.Time // time of the soonest crawl or zero if the queue is empty
+}
+
+// CrawlStats returns the sizes of the crawl queues.
+func (db *Database) CrawlStats() (*CrawlStats, error) {
+	c := db.conn("CrawlStats")
+	defer c.Close()
+	c.Send("SCARD", "newCrawl")
+	c.Send("ZCARD", "nextCrawl")
+	c.Send("ZRANGE", "nextCrawl", 0, 0, "WITHSCORES")
+	c.Send("ZCOUNT", "nextCrawl", "-inf", time.Now().Unix())
+	values, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	var stats CrawlStats
+	var next []interface{}
+	if _, err := redis.Scan(values, &stats.NewCrawl, &stats.NextCrawl, &next, &stats.Overdue); err != nil {
+		return nil, err
+	}
+	if len(next) == 2 {
+		t, err := redis.Int64(next[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		stats.Next = time.Unix(t, 0).UTC()
+	}
+	return &stats, nil
+}
+
+var incrementCounterScript = redis.NewScript(0, decayLua+`
     local key = 'counter:' .. ARGV[1]
     local n = tonumber(ARGV[2])
     local t = tonumber(ARGV[3])
@@ -983,7 +2848,7 @@ var incrementCounterScript = redis.NewScript(0, `
     local counter = redis.call('GET', key)
     if counter then
         counter = cjson.decode(counter)
-        n = n + counter.n * math.exp(counter.t - t)
+        n = n + decay(counter.n, counter.t, t)
     end
 
     redis.call('SET', key, cjson.encode({n = n; t = t}))
@@ -991,18 +2856,40 @@ var incrementCounterScript = redis.NewScript(0, `
     return tostring(n)
 `)
 
-const counterHalflife = time.Hour
+const (
+	counterHalflife = time.Hour
+
+	// counterExpire is the time a counter is kept after the last increment.
+	counterExpire = 4 * counterHalflife
+)
 
 func (db *Database) incrementCounterInternal(key string, delta float64, t time.Time) (float64, error) {
-	// nt = n0 * math.Exp(-lambda * t)
-	// lambda = math.Ln2 / thalf
-	c := db.Pool.Get()
+	c := db.conn("IncrementCounter")
 	defer c.Close()
-	const lambda = math.Ln2 / float64(counterHalflife)
-	scaledTime := lambda * float64(t.Sub(time.Unix(1257894000, 0)))
-	return redis.Float64(incrementCounterScript.Do(c, key, delta, scaledTime, (4*counterHalflife)/time.Second))
+	return redis.Float64(incrementCounterScript.Do(c, key, delta, scaledTime(t, counterHalflife), int64(counterExpire/time.Second)))
 }
 
 func (db *Database) IncrementCounter(key string, delta float64) (float64, error) {
 	return db.incrementCounterInternal(key, delta, time.Now())
 }
+
+var getCounterScript = redis.NewScript(0, decayLua+`
+    local counter = redis.call('GET', 'counter:' .. ARGV[1])
+    if not counter then
+        return '0'
+    end
+    counter = cjson.decode(counter)
+    return tostring(decay(counter.n, counter.t, tonumber(ARGV[2])))
+`)
+
+func (db *Database) getCounterInternal(key string, t time.Time) (float64, error) {
+	c := db.conn("GetCounter")
+	defer c.Close()
+	return redis.Float64(getCounterScript.Do(c, key, scaledTime(t, counterHalflife)))
+}
+
+// GetCounter returns the current value of the counter without modifying the
+// counter. Zero is returned for counters that do not exist.
+func (db *Database) GetCounter(key string) (float64, error) {
+	return db.getCounterInternal(key, time.Now())
+}
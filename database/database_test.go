@@ -15,8 +15,14 @@
 package database
 
 import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
 	"math"
+	"net"
 	"reflect"
+	"sort"
 	"strconv"
 	"testing"
 	"time"
@@ -68,10 +74,10 @@ func TestPutGet(t *testing.T) {
 		Updated:     time.Now().Add(-time.Hour),
 		Imports:     []string{"C", "errors", "github.com/user/repo/foo/bar"}, // self import for testing convenience.
 	}
-	if err := db.Put(pdoc, nextCrawl); err != nil {
+	if _, err := db.Put(pdoc, nextCrawl); err != nil {
 		t.Errorf("db.Put() returned error %v", err)
 	}
-	if err := db.Put(pdoc, time.Time{}); err != nil {
+	if _, err := db.Put(pdoc, time.Time{}); err != nil {
 		t.Errorf("second db.Put() returned error %v", err)
 	}
 
@@ -123,7 +129,7 @@ func TestPutGet(t *testing.T) {
 	if actualPdoc != nil {
 		t.Errorf("db.Get(.../foo) returned doc %v, want %v", actualPdoc, nil)
 	}
-	expectedSubdirs := []Package{{Path: "github.com/user/repo/foo/bar", Synopsis: "hello"}}
+	expectedSubdirs := []Package{{Path: "github.com/user/repo/foo/bar", Synopsis: "hello", Kind: "p"}}
 	if !reflect.DeepEqual(actualSubdirs, expectedSubdirs) {
 		t.Errorf("db.Get(.../foo) returned subdirs %v, want %v", actualSubdirs, expectedSubdirs)
 	}
@@ -131,7 +137,7 @@ func TestPutGet(t *testing.T) {
 	if err != nil {
 		t.Fatalf("db.Importers() retunred error %v", err)
 	}
-	expectedImporters := []Package{{"github.com/user/repo/foo/bar", "hello"}}
+	expectedImporters := []Package{{Path: "github.com/user/repo/foo/bar", Synopsis: "hello", Kind: "p"}}
 	if !reflect.DeepEqual(actualImporters, expectedImporters) {
 		t.Errorf("db.Importers() = %v, want %v", actualImporters, expectedImporters)
 	}
@@ -144,7 +150,7 @@ func TestPutGet(t *testing.T) {
 			actualImports[i].Synopsis = ""
 		}
 	}
-	expectedImports := []Package{{"C", ""}, {"errors", ""}, {"github.com/user/repo/foo/bar", "hello"}}
+	expectedImports := []Package{{Path: "C", Kind: "u"}, {Path: "errors", Kind: "u"}, {Path: "github.com/user/repo/foo/bar", Synopsis: "hello", Kind: "p"}}
 	if !reflect.DeepEqual(actualImports, expectedImports) {
 		t.Errorf("db.Imports() = %v, want %v", actualImports, expectedImports)
 	}
@@ -158,7 +164,7 @@ func TestPutGet(t *testing.T) {
 
 	db.Query("bar")
 
-	if err := db.Put(pdoc, time.Time{}); err != nil {
+	if _, err := db.Put(pdoc, time.Time{}); err != nil {
 		t.Errorf("db.Put() returned error %v", err)
 	}
 
@@ -182,6 +188,7 @@ func TestPutGet(t *testing.T) {
 	c.Send("DEL", "maxPackageId")
 	c.Send("DEL", "block")
 	c.Send("DEL", "popular:0")
+	c.Send("DEL", "popular:day:0")
 	c.Send("DEL", "newCrawl")
 	keys, err := redis.Values(c.Do("HKEYS", "ids"))
 	for _, key := range keys {
@@ -193,6 +200,1657 @@ func TestPutGet(t *testing.T) {
 	}
 }
 
+func TestBlock(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	if err := db.Block("github.com/user"); err != nil {
+		t.Fatalf("db.Block() returned error %v", err)
+	}
+	if err := db.Block("example.com/a"); err != nil {
+		t.Fatalf("db.Block() returned error %v", err)
+	}
+
+	blocked, err := db.IsBlocked("github.com/user/repo/foo")
+	if !blocked || err != nil {
+		t.Errorf("db.IsBlocked(github.com/user/repo/foo) returned %v, %v, want true, nil", blocked, err)
+	}
+
+	roots, err := db.Blocked()
+	expectedRoots := []string{"example.com/a", "github.com/user"}
+	if !reflect.DeepEqual(roots, expectedRoots) || err != nil {
+		t.Errorf("db.Blocked() returned %v, %v, want %v, nil", roots, err, expectedRoots)
+	}
+
+	if err := db.Unblock("github.com/user"); err != nil {
+		t.Fatalf("db.Unblock() returned error %v", err)
+	}
+
+	blocked, err = db.IsBlocked("github.com/user/repo/foo")
+	if blocked || err != nil {
+		t.Errorf("db.IsBlocked(github.com/user/repo/foo) after unblock returned %v, %v, want false, nil", blocked, err)
+	}
+
+	roots, err = db.Blocked()
+	expectedRoots = []string{"example.com/a"}
+	if !reflect.DeepEqual(roots, expectedRoots) || err != nil {
+		t.Errorf("db.Blocked() after unblock returned %v, %v, want %v, nil", roots, err, expectedRoots)
+	}
+
+	if err := db.BlockWithReason("example.com/spam", "spam"); err != nil {
+		t.Fatalf("db.BlockWithReason() returned error %v", err)
+	}
+	reasons, err := db.BlockedReasons()
+	expectedReasons := map[string]string{"example.com/a": "", "example.com/spam": "spam"}
+	if !reflect.DeepEqual(reasons, expectedReasons) || err != nil {
+		t.Errorf("db.BlockedReasons() returned %v, %v, want %v, nil", reasons, err, expectedReasons)
+	}
+}
+
+func TestRetryBadCrawls(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	pdoc := &doc.Package{
+		ImportPath:  "github.com/user/repo/foo",
+		ProjectRoot: "github.com/user/repo",
+	}
+	if _, err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatalf("db.Put() returned error %v", err)
+	}
+
+	for _, path := range []string{"github.com/user/repo/foo", "github.com/user/repo/bar", "github.com/user/repo/baz"} {
+		if err := db.AddBadCrawl(path); err != nil {
+			t.Fatalf("db.AddBadCrawl(%s) returned error %v", path, err)
+		}
+	}
+
+	n, err := db.BadCrawlCount()
+	if n != 3 || err != nil {
+		t.Errorf("db.BadCrawlCount() returned %d, %v, want 3, nil", n, err)
+	}
+
+	n, err = db.RetryBadCrawls()
+	if n != 2 || err != nil {
+		t.Errorf("db.RetryBadCrawls() returned %d, %v, want 2, nil", n, err)
+	}
+
+	n, err = db.BadCrawlCount()
+	if n != 0 || err != nil {
+		t.Errorf("db.BadCrawlCount() after retry returned %d, %v, want 0, nil", n, err)
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+	paths, _ := redis.Strings(c.Do("SMEMBERS", "newCrawl"))
+	sort.Strings(paths)
+	expectedPaths := []string{"github.com/user/repo/bar", "github.com/user/repo/baz"}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("newCrawl = %v, want %v", paths, expectedPaths)
+	}
+}
+
+func TestQueryPage(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for i := 0; i < 5; i++ {
+		pdoc := &doc.Package{
+			ImportPath:  "github.com/user/repo/p" + strconv.Itoa(i),
+			ProjectRoot: "github.com/user/repo",
+			Name:        "p" + strconv.Itoa(i),
+			Synopsis:    "Package p" + strconv.Itoa(i) + " parses widgets.",
+			Doc:         "Package p" + strconv.Itoa(i) + " parses widgets.",
+			Funcs:       []*doc.Func{{}},
+		}
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put() returned error %v", err)
+		}
+	}
+
+	pkgs, total, err := db.QueryPage("widgets", 0, 2)
+	if len(pkgs) != 2 || total != 5 || err != nil {
+		t.Errorf("db.QueryPage(widgets, 0, 2) returned %d packages, %d, %v, want 2, 5, nil", len(pkgs), total, err)
+	}
+
+	pkgs, total, err = db.QueryPage("widgets", 4, 2)
+	if len(pkgs) != 1 || total != 5 || err != nil {
+		t.Errorf("db.QueryPage(widgets, 4, 2) returned %d packages, %d, %v, want 1, 5, nil", len(pkgs), total, err)
+	}
+
+	pkgs, err = db.Query("widgets")
+	if len(pkgs) != 5 || err != nil {
+		t.Errorf("db.Query(widgets) returned %d packages, %v, want 5, nil", len(pkgs), err)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, name := range []string{"strconv", "strings", "sort"} {
+		pdoc := &doc.Package{
+			ImportPath: name,
+			Name:       name,
+			Synopsis:   "Package " + name + ".",
+			Doc:        "Package " + name + ".",
+			Funcs:      []*doc.Func{{}},
+		}
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put() returned error %v", err)
+		}
+	}
+
+	for _, tt := range []struct {
+		prefix string
+		paths  []string
+	}{
+		{"s", nil},
+		{"St", []string{"strconv", "strings"}},
+		{"so", []string{"sort"}},
+		{"strc", []string{"strconv"}},
+		{"strin", []string{"strings"}},
+		{"x", nil},
+	} {
+		pkgs, err := db.Suggest(tt.prefix)
+		if err != nil {
+			t.Fatalf("db.Suggest(%q) returned error %v", tt.prefix, err)
+		}
+		var paths []string
+		for _, pkg := range pkgs {
+			paths = append(paths, pkg.Path)
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, tt.paths) {
+			t.Errorf("db.Suggest(%q) = %v, want %v", tt.prefix, paths, tt.paths)
+		}
+	}
+}
+
+func TestImportGraph(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/user/b", Name: "b", Imports: []string{"github.com/user/c"}},
+		{ImportPath: "github.com/user/c", Name: "c", Imports: []string{"fmt"}},
+		{ImportPath: "github.com/user/d", Name: "d"},
+	} {
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put() returned error %v", err)
+		}
+	}
+
+	root := &doc.Package{
+		ImportPath:   "github.com/user/a",
+		Name:         "a",
+		Imports:      []string{"github.com/user/b"},
+		TestImports:  []string{"github.com/user/b", "github.com/user/d"},
+		XTestImports: []string{"github.com/user/a"},
+	}
+
+	for _, tt := range []struct {
+		maxDepth     int
+		includeTests bool
+		paths        []string
+		edges        [][2]int
+		testEdges    []bool
+	}{
+		{0, false, []string{"github.com/user/a", "github.com/user/b", "github.com/user/c", "fmt"}, [][2]int{{0, 1}, {1, 2}, {2, 3}}, []bool{false, false, false}},
+		{1, false, []string{"github.com/user/a", "github.com/user/b"}, [][2]int{{0, 1}}, []bool{false}},
+		{2, true, []string{"github.com/user/a", "github.com/user/b", "github.com/user/d", "github.com/user/c"}, [][2]int{{0, 1}, {0, 2}, {1, 3}}, []bool{false, true, false}},
+	} {
+		nodes, edges, testEdges, err := db.ImportGraph(root, false, tt.maxDepth, tt.includeTests)
+		if err != nil {
+			t.Fatalf("db.ImportGraph(%d, %v) returned error %v", tt.maxDepth, tt.includeTests, err)
+		}
+		var paths []string
+		for _, node := range nodes {
+			paths = append(paths, node.Path)
+		}
+		if !reflect.DeepEqual(paths, tt.paths) {
+			t.Errorf("db.ImportGraph(%d, %v) returned nodes %v, want %v", tt.maxDepth, tt.includeTests, paths, tt.paths)
+		}
+		if !reflect.DeepEqual(edges, tt.edges) {
+			t.Errorf("db.ImportGraph(%d, %v) returned edges %v, want %v", tt.maxDepth, tt.includeTests, edges, tt.edges)
+		}
+		if !reflect.DeepEqual(testEdges, tt.testEdges) {
+			t.Errorf("db.ImportGraph(%d, %v) returned test edges %v, want %v", tt.maxDepth, tt.includeTests, testEdges, tt.testEdges)
+		}
+	}
+
+	p, err := db.ImportGraphJSON(root, true)
+	if err != nil {
+		t.Fatalf("db.ImportGraphJSON() returned error %v", err)
+	}
+	want := `{"nodes":[{"path":"github.com/user/a"},{"path":"github.com/user/b"},{"path":"github.com/user/c"},{"path":"fmt"}],"edges":[[0,1],[1,2],[2,3]]}`
+	if string(p) != want {
+		t.Errorf("db.ImportGraphJSON() = %s, want %s", p, want)
+	}
+}
+
+func TestReverseImportGraph(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/user/a", Name: "a"},
+		{ImportPath: "github.com/user/b", Name: "b", Imports: []string{"github.com/user/a"}},
+		{ImportPath: "github.com/user/c", Name: "c", Imports: []string{"github.com/user/b", "github.com/user/d"}},
+		{ImportPath: "github.com/user/d", Name: "d", Imports: []string{"github.com/user/a"}},
+	} {
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put() returned error %v", err)
+		}
+	}
+
+	root := &doc.Package{ImportPath: "github.com/user/a", Name: "a"}
+
+	for _, tt := range []struct {
+		maxDepth int
+		paths    []string
+		edges    [][2]int
+	}{
+		{1, []string{"github.com/user/a", "github.com/user/b", "github.com/user/d"}, [][2]int{{1, 0}, {2, 0}}},
+		{2, []string{"github.com/user/a", "github.com/user/b", "github.com/user/d", "github.com/user/c"}, [][2]int{{1, 0}, {2, 0}, {3, 1}, {3, 2}}},
+	} {
+		nodes, edges, err := db.ReverseImportGraph(root, tt.maxDepth)
+		if err != nil {
+			t.Fatalf("db.ReverseImportGraph(%d) returned error %v", tt.maxDepth, err)
+		}
+		var paths []string
+		for _, node := range nodes {
+			paths = append(paths, node.Path)
+		}
+		if !reflect.DeepEqual(paths, tt.paths) {
+			t.Errorf("db.ReverseImportGraph(%d) returned nodes %v, want %v", tt.maxDepth, paths, tt.paths)
+		}
+		if !reflect.DeepEqual(edges, tt.edges) {
+			t.Errorf("db.ReverseImportGraph(%d) returned edges %v, want %v", tt.maxDepth, edges, tt.edges)
+		}
+	}
+}
+
+func TestPutBatch(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	nextCrawl := time.Now().Add(time.Hour)
+	pdocs := []*doc.Package{
+		{ImportPath: "github.com/user/repo/a", ProjectRoot: "github.com/user/repo", Name: "a", Synopsis: "a", Etag: "1"},
+		{ImportPath: "github.com/user/repo/b", ProjectRoot: "github.com/user/repo", Name: "b", Synopsis: "b", Etag: "1", Imports: []string{"example.com/c"}},
+	}
+	if err := db.PutBatch(pdocs, nextCrawl); err != nil {
+		t.Fatalf("db.PutBatch() returned error %v", err)
+	}
+
+	for _, pdoc := range pdocs {
+		actualPdoc, _, err := db.GetDoc(pdoc.ImportPath)
+		if err != nil {
+			t.Fatalf("db.GetDoc(%s) returned error %v", pdoc.ImportPath, err)
+		}
+		if actualPdoc == nil || actualPdoc.Synopsis != pdoc.Synopsis {
+			t.Errorf("db.GetDoc(%s) returned %v, want synopsis %q", pdoc.ImportPath, actualPdoc, pdoc.Synopsis)
+		}
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+	paths, _ := redis.Strings(c.Do("SMEMBERS", "newCrawl"))
+	sort.Strings(paths)
+	expectedPaths := []string{"example.com/c", "github.com/user/repo"}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("newCrawl = %v, want %v", paths, expectedPaths)
+	}
+
+	// Related packages are not added when the etags did not change.
+	c.Do("DEL", "newCrawl")
+	if err := db.PutBatch(pdocs, nextCrawl); err != nil {
+		t.Fatalf("db.PutBatch() returned error %v", err)
+	}
+	if n, _ := redis.Int(c.Do("SCARD", "newCrawl")); n != 0 {
+		t.Errorf("newCrawl has %d paths after unchanged PutBatch, want 0", n)
+	}
+}
+
+func TestQueryWithCorrection(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	pdoc := &doc.Package{
+		ImportPath: "github.com/user/mgo",
+		Name:       "mgo",
+		Synopsis:   "Package mgo is a driver for mongodb.",
+		Doc:        "Package mgo is a driver for mongodb.",
+		Funcs:      []*doc.Func{{}},
+	}
+	if _, err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatalf("db.Put() returned error %v", err)
+	}
+
+	pkgs, corrected, err := db.QueryWithCorrection("mongodb")
+	if len(pkgs) != 1 || corrected != "" || err != nil {
+		t.Errorf("db.QueryWithCorrection(mongodb) returned %v, %q, %v, want 1 package, \"\", nil", pkgs, corrected, err)
+	}
+
+	pkgs, corrected, err = db.QueryWithCorrection("mongdb driver")
+	if len(pkgs) != 1 || corrected != "mongodb driver" || err != nil {
+		t.Errorf("db.QueryWithCorrection(mongdb driver) returned %v, %q, %v, want 1 package, \"mongodb driver\", nil", pkgs, corrected, err)
+	}
+
+	// The corrected word is shown, not the stem.
+	pdoc = &doc.Package{ImportPath: "github.com/user/parse", Name: "parse", Synopsis: "Package parse is for parsing files.", Funcs: []*doc.Func{{}}}
+	if _, err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatalf("db.Put() returned error %v", err)
+	}
+	pkgs, corrected, err = db.QueryWithCorrection("parsding")
+	if len(pkgs) != 1 || corrected != "parsing" || err != nil {
+		t.Errorf("db.QueryWithCorrection(parsding) returned %v, %q, %v, want 1 package, \"parsing\", nil", pkgs, corrected, err)
+	}
+
+	pkgs, corrected, err = db.QueryWithCorrection("postgres")
+	if len(pkgs) != 0 || corrected != "" || err != nil {
+		t.Errorf("db.QueryWithCorrection(postgres) returned %v, %q, %v, want no packages, \"\", nil", pkgs, corrected, err)
+	}
+}
+
+func TestQueryPlatform(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/user/any", Name: "any", Synopsis: "Package any reads files."},
+		{ImportPath: "github.com/user/win", Name: "win", Synopsis: "Package win reads files.", Platforms: []string{"windows"}},
+		{ImportPath: "github.com/user/unix", Name: "unix", Synopsis: "Package unix reads files.", Platforms: []string{"darwin", "linux"}},
+		{ImportPath: "github.com/user/simd", Name: "simd", Synopsis: "Package simd reads files.", Platforms: []string{"amd64"}},
+		{ImportPath: "github.com/user/winarm", Name: "winarm", Synopsis: "Package winarm reads files.", Platforms: []string{"arm", "windows"}},
+	} {
+		pdoc.Funcs = []*doc.Func{{}}
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+
+	for q, want := range map[string][]string{
+		"files":                  {"github.com/user/any", "github.com/user/simd", "github.com/user/unix", "github.com/user/win", "github.com/user/winarm"},
+		"files platform:windows": {"github.com/user/any", "github.com/user/simd", "github.com/user/win", "github.com/user/winarm"},
+		"files platform:linux":   {"github.com/user/any", "github.com/user/simd", "github.com/user/unix"},
+		"files platform:plan9":   {"github.com/user/any", "github.com/user/simd"},
+		"files platform:amd64":   {"github.com/user/any", "github.com/user/simd", "github.com/user/unix", "github.com/user/win"},
+		"files platform:arm":     {"github.com/user/any", "github.com/user/unix", "github.com/user/win", "github.com/user/winarm"},
+	} {
+		pkgs, err := db.Query(q)
+		if err != nil {
+			t.Fatalf("db.Query(%q) returned error %v", q, err)
+		}
+		var got []string
+		for _, pkg := range pkgs {
+			got = append(got, pkg.Path)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("db.Query(%q) = %v, want %v", q, got, want)
+		}
+		n, err := db.QueryCount(q)
+		if n != len(want) || err != nil {
+			t.Errorf("db.QueryCount(%q) returned %d, %v, want %d, nil", q, n, err, len(want))
+		}
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+	keys, _ := redis.Strings(c.Do("KEYS", "tmp:*"))
+	if len(keys) != 0 {
+		t.Errorf("temporary keys %v not deleted", keys)
+	}
+}
+
+func TestQuerySorted(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/user/b", Name: "b", Synopsis: "Package b reads files."},
+		{ImportPath: "github.com/user/a/sub", Name: "sub", Synopsis: "Package sub reads files."},
+		{ImportPath: "github.com/user/c", Name: "c", Synopsis: "Reads files."},
+	} {
+		pdoc.Doc = pdoc.Synopsis
+		pdoc.Funcs = []*doc.Func{{}}
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+	now := time.Now()
+	if err := db.incrementPopularScoreInternal("github.com/user/c", 2, now); err != nil {
+		t.Fatalf("db.incrementPopularScoreInternal() returned error %v", err)
+	}
+	if err := db.incrementPopularScoreInternal("github.com/user/a/sub", 1, now); err != nil {
+		t.Fatalf("db.incrementPopularScoreInternal() returned error %v", err)
+	}
+
+	for order, want := range map[string][]string{
+		"score":   {"github.com/user/b", "github.com/user/a/sub", "github.com/user/c"},
+		"path":    {"github.com/user/a/sub", "github.com/user/b", "github.com/user/c"},
+		"popular": {"github.com/user/c", "github.com/user/a/sub", "github.com/user/b"},
+	} {
+		pkgs, err := db.QuerySorted("files", order)
+		if err != nil {
+			t.Fatalf("db.QuerySorted(%q) returned error %v", order, err)
+		}
+		var got []string
+		for _, pkg := range pkgs {
+			got = append(got, pkg.Path)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("db.QuerySorted(%q) = %v, want %v", order, got, want)
+		}
+	}
+
+	if _, err := db.QuerySorted("files", "random"); err == nil {
+		t.Errorf("db.QuerySorted(random) did not return an error")
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+	keys, _ := redis.Strings(c.Do("KEYS", "tmp:*"))
+	if len(keys) != 0 {
+		t.Errorf("temporary keys %v not deleted", keys)
+	}
+}
+
+func TestGetWithDirs(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/user/repo", ProjectRoot: "github.com/user/repo", Name: "repo"},
+		{ImportPath: "github.com/user/repo/dir", ProjectRoot: "github.com/user/repo"},
+		{ImportPath: "github.com/user/repo/dir/sub", ProjectRoot: "github.com/user/repo", Name: "sub", Synopsis: "sub"},
+	} {
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+
+	_, subdirs, _, err := db.Get("github.com/user/repo")
+	if err != nil {
+		t.Fatalf("db.Get() returned error %v", err)
+	}
+	expected := []Package{{Path: "github.com/user/repo/dir/sub", Synopsis: "sub", Kind: "p"}}
+	if !reflect.DeepEqual(subdirs, expected) {
+		t.Errorf("db.Get() returned subdirs %v, want %v", subdirs, expected)
+	}
+
+	_, subdirs, _, err = db.GetWithDirs("github.com/user/repo")
+	if err != nil {
+		t.Fatalf("db.GetWithDirs() returned error %v", err)
+	}
+	expected = []Package{
+		{Path: "github.com/user/repo/dir", Kind: "d"},
+		{Path: "github.com/user/repo/dir/sub", Synopsis: "sub", Kind: "p"},
+	}
+	if !reflect.DeepEqual(subdirs, expected) {
+		t.Errorf("db.GetWithDirs() returned subdirs %v, want %v", subdirs, expected)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	defer func(n int) { *maxVersions = n }(*maxVersions)
+	*maxVersions = 2
+
+	db := newDB(t)
+	defer closeDB(db)
+
+	const path = "github.com/user/repo"
+	for _, etag := range []string{"a", "b", "c"} {
+		pdoc := &doc.Package{ImportPath: path, Name: "repo", Synopsis: "version " + etag, Etag: etag}
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", etag, err)
+		}
+	}
+
+	versions, err := db.Versions(path)
+	if err != nil {
+		t.Fatalf("db.Versions() returned error %v", err)
+	}
+	if expected := []string{"c", "b"}; !reflect.DeepEqual(versions, expected) {
+		t.Errorf("db.Versions() = %v, want %v", versions, expected)
+	}
+
+	pdoc, err := db.GetDocVersion(path, "b")
+	if err != nil {
+		t.Fatalf("db.GetDocVersion(b) returned error %v", err)
+	}
+	if pdoc == nil || pdoc.Synopsis != "version b" {
+		t.Errorf("db.GetDocVersion(b) = %+v, want version b", pdoc)
+	}
+
+	pdoc, err = db.GetDocVersion(path, "a")
+	if pdoc != nil || err != nil {
+		t.Errorf("db.GetDocVersion(a) = %+v, %v, want nil, nil", pdoc, err)
+	}
+
+	n := 0
+	if err := db.Do(func(*PackageInfo) error { n++; return nil }); err != nil || n != 1 {
+		t.Errorf("db.Do() visited %d packages and returned %v, want 1, nil", n, err)
+	}
+	if stats, err := db.Stats(); err != nil || stats.Packages != 1 {
+		t.Errorf("db.Stats() returned %+v, %v, want 1 package", stats, err)
+	}
+
+	if err := db.Delete(path); err != nil {
+		t.Fatalf("db.Delete() returned error %v", err)
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	keys, _ := redis.Strings(c.Do("KEYS", "pkg:*"))
+	if len(keys) != 0 {
+		t.Errorf("version keys %v not deleted", keys)
+	}
+}
+
+func TestImportersPage(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, name := range []string{"c", "a", "d", "b"} {
+		pdoc := &doc.Package{ImportPath: "github.com/user/" + name, Name: name, Imports: []string{"github.com/user/lib"}}
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+
+	pkgs, err := db.ImportersPage("github.com/user/lib", 1, 2)
+	if err != nil {
+		t.Fatalf("db.ImportersPage() returned error %v", err)
+	}
+	expected := []Package{{Path: "github.com/user/b", Kind: "p"}, {Path: "github.com/user/c", Kind: "p"}}
+	if !reflect.DeepEqual(pkgs, expected) {
+		t.Errorf("db.ImportersPage() = %v, want %v", pkgs, expected)
+	}
+}
+
+func TestQueryDeprecated(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/user/old", Name: "old", Synopsis: "Package old reads files.", Deprecated: true},
+		{ImportPath: "github.com/user/new", Name: "new", Synopsis: "Package new reads files."},
+	} {
+		pdoc.Doc = pdoc.Synopsis
+		pdoc.Funcs = []*doc.Func{{}}
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+
+	for q, want := range map[string][]Package{
+		"files": {
+			{Path: "github.com/user/new", Synopsis: "Package new reads files.", Kind: "p"},
+			{Path: "github.com/user/old", Synopsis: "Package old reads files.", Kind: "p", Deprecated: true},
+		},
+		"files is:deprecated": {
+			{Path: "github.com/user/old", Synopsis: "Package old reads files.", Kind: "p", Deprecated: true},
+		},
+		"files -is:deprecated": {
+			{Path: "github.com/user/new", Synopsis: "Package new reads files.", Kind: "p"},
+		},
+	} {
+		pkgs, err := db.Query(q)
+		if err != nil {
+			t.Fatalf("db.Query(%q) returned error %v", q, err)
+		}
+		if !reflect.DeepEqual(pkgs, want) {
+			t.Errorf("db.Query(%q) = %v, want %v", q, pkgs, want)
+		}
+	}
+}
+
+func TestReindex(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	pdoc := &doc.Package{ImportPath: "github.com/user/repo", Name: "repo", Synopsis: "Package repo reads files.", Etag: "e"}
+	pdoc.Doc = pdoc.Synopsis
+	pdoc.Funcs = []*doc.Func{{}}
+	nextCrawl := time.Unix(time.Now().Add(time.Hour).Unix(), 0).UTC()
+	if _, err := db.Put(pdoc, nextCrawl); err != nil {
+		t.Fatalf("db.Put() returned error %v", err)
+	}
+
+	// Simulate a record indexed with an older version of the ranking code.
+	c := db.Pool.Get()
+	defer c.Close()
+	id, _ := redis.String(c.Do("HGET", "ids", pdoc.ImportPath))
+	c.Send("HMSET", "pkg:"+id, "score", 0, "terms", "stale")
+	c.Send("SADD", "index:stale", id)
+	c.Send("SREM", "index:read", id)
+	c.Send("DEL", "terms:fi")
+	if _, err := c.Do(""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Reindex(); err != nil {
+		t.Fatalf("db.Reindex() returned error %v", err)
+	}
+
+	for q, want := range map[string]int{"read": 1, "stale": 0} {
+		if n, err := db.QueryCount(q); n != want || err != nil {
+			t.Errorf("db.QueryCount(%q) returned %d, %v, want %d, nil", q, n, err, want)
+		}
+	}
+	if ok, _ := redis.Bool(c.Do("SISMEMBER", "terms:fi", "file")); !ok {
+		t.Errorf("terms:fi does not contain file after reindex")
+	}
+	score, _ := redis.Float64(c.Do("HGET", "pkg:"+id, "score"))
+	if expected := documentScore(pdoc); score != expected {
+		t.Errorf("score = %v, want %v", score, expected)
+	}
+	crawl, _ := redis.Int64(c.Do("ZSCORE", "nextCrawl", id))
+	etag, _ := redis.String(c.Do("HGET", "pkg:"+id, "etag"))
+	if crawl != nextCrawl.Unix() || etag != "e" {
+		t.Errorf("crawl = %d, etag = %q, want %d, e", crawl, etag, nextCrawl.Unix())
+	}
+}
+
+func TestCrawlStats(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	stats, err := db.CrawlStats()
+	if err != nil {
+		t.Fatalf("db.CrawlStats() returned error %v", err)
+	}
+	if expected := (CrawlStats{}); *stats != expected {
+		t.Errorf("db.CrawlStats() = %+v, want %+v", stats, expected)
+	}
+
+	now := time.Unix(time.Now().Unix(), 0).UTC()
+	for i, d := range []time.Duration{-2 * time.Hour, -time.Hour, time.Hour} {
+		pdoc := &doc.Package{ImportPath: "github.com/user/repo" + strconv.Itoa(i), Name: "repo"}
+		if _, err := db.Put(pdoc, now.Add(d)); err != nil {
+			t.Fatalf("db.Put() returned error %v", err)
+		}
+	}
+	if err := db.AddNewCrawl("github.com/user/new"); err != nil {
+		t.Fatalf("db.AddNewCrawl() returned error %v", err)
+	}
+
+	stats, err = db.CrawlStats()
+	if err != nil {
+		t.Fatalf("db.CrawlStats() returned error %v", err)
+	}
+	expected := CrawlStats{NewCrawl: 1, NextCrawl: 3, Overdue: 2, Next: now.Add(-2 * time.Hour)}
+	if *stats != expected {
+		t.Errorf("db.CrawlStats() = %+v, want %+v", stats, expected)
+	}
+}
+
+func TestAlias(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	if err := db.PutAlias("github.com/old/pkg", "github.com/new/pkg"); err != nil {
+		t.Fatalf("db.PutAlias() returned error %v", err)
+	}
+	path, _, err := db.PopNewCrawl()
+	if path != "github.com/new/pkg" || err != nil {
+		t.Errorf("db.PopNewCrawl() returned %q, %v, want github.com/new/pkg, nil", path, err)
+	}
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/new/pkg", ProjectRoot: "github.com/new/pkg", Name: "pkg"},
+		{ImportPath: "github.com/user/a", Name: "a", Imports: []string{"github.com/old/pkg"}},
+		{ImportPath: "github.com/user/b", Name: "b", Imports: []string{"github.com/new/pkg"}},
+		{ImportPath: "github.com/user/c", Name: "c", Imports: []string{"github.com/old/pkg", "github.com/new/pkg"}},
+	} {
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+
+	for _, path := range []string{"github.com/new/pkg", "github.com/old/pkg"} {
+		actual, _, _, err := db.Get(path)
+		if err != nil {
+			t.Fatalf("db.Get(%q) returned error %v", path, err)
+		}
+		if actual == nil || actual.ImportPath != "github.com/new/pkg" {
+			t.Errorf("db.Get(%q) returned %+v, want github.com/new/pkg", path, actual)
+		}
+	}
+
+	if ok, err := db.Exists("github.com/old/pkg"); ok || err != nil {
+		t.Errorf("db.Exists(alias) returned %v, %v, want false, nil", ok, err)
+	}
+
+	if n, err := db.ImporterCount("github.com/new/pkg"); n != 3 || err != nil {
+		t.Errorf("db.ImporterCount() returned %d, %v, want 3, nil", n, err)
+	}
+	counts, err := db.ImporterCounts([]string{"github.com/new/pkg", "github.com/old/pkg"})
+	if err != nil {
+		t.Fatalf("db.ImporterCounts() returned error %v", err)
+	}
+	if counts["github.com/new/pkg"] != 3 || counts["github.com/old/pkg"] != 2 {
+		t.Errorf("db.ImporterCounts() returned %v, want new 3, old 2", counts)
+	}
+
+	importers, err := db.Importers("github.com/new/pkg")
+	if err != nil {
+		t.Fatalf("db.Importers() returned error %v", err)
+	}
+	var paths []string
+	for _, pkg := range importers {
+		paths = append(paths, pkg.Path)
+	}
+	if expected := []string{"github.com/user/a", "github.com/user/b", "github.com/user/c"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("db.Importers() returned %v, want %v", paths, expected)
+	}
+	if importers, err := db.ImportersPage("github.com/new/pkg", 1, 1); err != nil || len(importers) != 1 || importers[0].Path != "github.com/user/b" {
+		t.Errorf("db.ImportersPage() returned %v, %v, want github.com/user/b", importers, err)
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+	keys, _ := redis.Strings(c.Do("KEYS", "tmp:*"))
+	if len(keys) != 0 {
+		t.Errorf("temporary keys %v not deleted", keys)
+	}
+}
+
+func TestQueryWeights(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/user/cfg", ProjectName: "yaml", Name: "cfg", Synopsis: "Package cfg reads settings."},
+		{ImportPath: "github.com/user/conf", Name: "conf", Synopsis: "Package conf reads YAML files."},
+		{ImportPath: "github.com/user/yaml", Name: "yaml", Synopsis: "Package yaml reads files."},
+	} {
+		pdoc.Doc = pdoc.Synopsis
+		pdoc.Funcs = []*doc.Func{{}}
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+
+	pkgs, err := db.Query("yaml")
+	if err != nil {
+		t.Fatalf("db.Query() returned error %v", err)
+	}
+	var actual []string
+	for _, pkg := range pkgs {
+		actual = append(actual, pkg.Path)
+	}
+	expected := []string{"github.com/user/yaml", "github.com/user/conf", "github.com/user/cfg"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("db.Query(yaml) = %v, want %v", actual, expected)
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+	keys, _ := redis.Strings(c.Do("KEYS", "tmp:*"))
+	if len(keys) != 0 {
+		t.Errorf("temporary keys %v not deleted", keys)
+	}
+
+	for _, path := range expected {
+		if err := db.Delete(path); err != nil {
+			t.Fatalf("db.Delete(%q) returned error %v", path, err)
+		}
+	}
+	keys, _ = redis.Strings(c.Do("KEYS", "weight:*"))
+	if n, _ := redis.Int(c.Do("ZCARD", "score")); len(keys) != 0 || n != 0 {
+		t.Errorf("weight keys %v and %d scores not deleted", keys, n)
+	}
+}
+
+func TestQueryNegation(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/user/jsonrpc", Name: "jsonrpc", Synopsis: "Package jsonrpc implements JSON RPC."},
+		{ImportPath: "github.com/user/json", Name: "json", Synopsis: "Package json encodes JSON values."},
+		{ImportPath: "github.com/user/rpc", Name: "rpc", Synopsis: "Package rpc implements RPC."},
+	} {
+		pdoc.Doc = pdoc.Synopsis
+		pdoc.Funcs = []*doc.Func{{}}
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+
+	for q, want := range map[string][]string{
+		"json -rpc": {"github.com/user/json"},
+		"-rpc":      nil,
+	} {
+		pkgs, err := db.Query(q)
+		if err != nil {
+			t.Fatalf("db.Query(%q) returned error %v", q, err)
+		}
+		var got []string
+		for _, pkg := range pkgs {
+			got = append(got, pkg.Path)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("db.Query(%q) = %v, want %v", q, got, want)
+		}
+		n, err := db.QueryCount(q)
+		if n != len(want) || err != nil {
+			t.Errorf("db.QueryCount(%q) returned %d, %v, want %d, nil", q, n, err, len(want))
+		}
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+	keys, _ := redis.Strings(c.Do("KEYS", "tmp:*"))
+	if len(keys) != 0 {
+		t.Errorf("temporary keys %v not deleted", keys)
+	}
+}
+
+func TestClaimNextCrawl(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	now := time.Now()
+	for path, d := range map[string]time.Duration{
+		"github.com/user/a": -2 * time.Hour,
+		"github.com/user/b": -time.Hour,
+		"github.com/user/c": time.Hour,
+	} {
+		if _, err := db.Put(&doc.Package{ImportPath: path, Name: "p"}, now.Add(d)); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", path, err)
+		}
+	}
+
+	for _, expected := range []string{"github.com/user/a", "github.com/user/b", ""} {
+		path, err := db.ClaimNextCrawl(30 * time.Minute)
+		if path != expected || err != nil {
+			t.Errorf("db.ClaimNextCrawl() returned %q, %v, want %q, nil", path, err, expected)
+		}
+	}
+
+	_, nextCrawl, err := db.GetDoc("github.com/user/a")
+	if err != nil {
+		t.Fatalf("db.GetDoc() returned error %v", err)
+	}
+	if d := nextCrawl.Sub(now); d < 29*time.Minute || d > 31*time.Minute {
+		t.Errorf("next crawl after claim is %v from now, want 30m", d)
+	}
+}
+
+func TestQueryProject(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/gorilla/mux", ProjectRoot: "github.com/gorilla/mux", Name: "mux", Synopsis: "Package mux routes requests."},
+		{ImportPath: "github.com/gorilla/pat", ProjectRoot: "github.com/gorilla/pat", Name: "pat", Synopsis: "Package pat routes requests."},
+		{ImportPath: "github.com/user/mux", ProjectRoot: "github.com/user/mux", Name: "mux", Synopsis: "Package mux routes requests."},
+	} {
+		pdoc.Doc = pdoc.Synopsis
+		pdoc.Funcs = []*doc.Func{{}}
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+
+	for q, want := range map[string][]string{
+		"routes project:github.com/gorilla/mux": {"github.com/gorilla/mux"},
+		"routes project:github.com/gorilla":     {"github.com/gorilla/mux", "github.com/gorilla/pat"},
+		"project:github.com/gorilla/":           {"github.com/gorilla/mux", "github.com/gorilla/pat"},
+		"mux project:github.com/gorilla":        {"github.com/gorilla/mux"},
+	} {
+		pkgs, err := db.Query(q)
+		if err != nil {
+			t.Fatalf("db.Query(%q) returned error %v", q, err)
+		}
+		var got []string
+		for _, pkg := range pkgs {
+			got = append(got, pkg.Path)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("db.Query(%q) = %v, want %v", q, got, want)
+		}
+		n, err := db.QueryCount(q)
+		if n != len(want) || err != nil {
+			t.Errorf("db.QueryCount(%q) returned %d, %v, want %d, nil", q, n, err, len(want))
+		}
+	}
+
+	pkgs, total, err := db.QueryPage("routes project:github.com/gorilla", 1, 1)
+	if len(pkgs) != 1 || total != 2 || err != nil {
+		t.Errorf("db.QueryPage() returned %v, %d, %v, want 1 package, 2, nil", pkgs, total, err)
+	}
+}
+
+func TestPopularScore(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	const path = "github.com/user/repo"
+	if _, err := db.Put(&doc.Package{ImportPath: path, Name: "repo"}, time.Time{}); err != nil {
+		t.Fatalf("db.Put() returned error %v", err)
+	}
+
+	if score, err := db.PopularScore(path); score != 0 || err != nil {
+		t.Errorf("db.PopularScore() before increment returned %v, %v, want 0, nil", score, err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := db.incrementPopularScoreInternal(path, 1, now); err != nil {
+			t.Fatalf("db.incrementPopularScoreInternal() returned error %v", err)
+		}
+	}
+
+	for _, tt := range []struct {
+		t        time.Time
+		expected float64
+	}{
+		{now, 4},
+		{now.Add(popularHalfLife), 2},
+		{now.Add(2 * popularHalfLife), 1},
+	} {
+		score, err := db.popularScoreInternal(path, tt.t)
+		if err != nil {
+			t.Fatalf("db.popularScoreInternal() returned error %v", err)
+		}
+		if math.Abs(score-tt.expected) > 1e-3 {
+			t.Errorf("db.popularScoreInternal(%v) = %v, want %v", tt.t.Sub(now), score, tt.expected)
+		}
+	}
+
+	if score, err := db.PopularScore("github.com/user/missing"); score != 0 || err != nil {
+		t.Errorf("db.PopularScore(missing) returned %v, %v, want 0, nil", score, err)
+	}
+}
+
+func TestPutUnchanged(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	const path = "github.com/user/repo"
+	nextCrawl := time.Unix(time.Now().Add(time.Hour).Unix(), 0).UTC()
+	pdoc := &doc.Package{ImportPath: path, Name: "repo", Synopsis: "Package repo.", Etag: "a"}
+	if changed, err := db.Put(pdoc, nextCrawl); !changed || err != nil {
+		t.Fatalf("db.Put() returned %v, %v, want true, nil", changed, err)
+	}
+
+	// The etag is unchanged, so only the crawl time is updated.
+	nextCrawl = nextCrawl.Add(time.Hour)
+	pdoc = &doc.Package{ImportPath: path, Name: "repo", Synopsis: "Package repo reads.", Etag: "a"}
+	if changed, err := db.Put(pdoc, nextCrawl); changed || err != nil {
+		t.Fatalf("second db.Put() returned %v, %v, want false, nil", changed, err)
+	}
+	actual, _, actualCrawl, err := db.Get(path)
+	if err != nil {
+		t.Fatalf("db.Get() returned error %v", err)
+	}
+	if actual.Synopsis != "Package repo." {
+		t.Errorf("db.Get() returned synopsis %q, want %q", actual.Synopsis, "Package repo.")
+	}
+	if !actualCrawl.Equal(nextCrawl) {
+		t.Errorf("db.Get() returned crawl %v, want %v", actualCrawl, nextCrawl)
+	}
+
+	// A save without a crawl time is always a full save.
+	if changed, err := db.Put(pdoc, time.Time{}); !changed || err != nil {
+		t.Fatalf("db.Put(zero crawl) returned %v, %v, want true, nil", changed, err)
+	}
+
+	// A clone match follows the clone path.
+	c := db.Pool.Get()
+	defer c.Close()
+	id, _ := redis.String(c.Do("HGET", "ids", path))
+	c.Do("HSET", "pkg:"+id, "clone", "a")
+	if changed, err := db.Put(pdoc, nextCrawl); !changed || err != nil {
+		t.Fatalf("db.Put(clone) returned %v, %v, want true, nil", changed, err)
+	}
+	if score, _ := redis.Float64(c.Do("HGET", "pkg:"+id, "score")); score != 0 {
+		t.Errorf("score after clone put = %v, want 0", score)
+	}
+}
+
+func TestProjectStats(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	const root = "github.com/user/repo"
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: root, ProjectRoot: root, Name: "repo", Synopsis: "Package repo."},
+		{ImportPath: root + "/cmd", ProjectRoot: root, Name: "main", IsCmd: true},
+		{ImportPath: root + "/dir", ProjectRoot: root},
+		{ImportPath: "github.com/user/a", ProjectRoot: "github.com/user/a", Name: "a", Imports: []string{root, root + "/cmd"}},
+		{ImportPath: "github.com/user/b", ProjectRoot: "github.com/user/b", Name: "b", Imports: []string{root}},
+	} {
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+
+	stats, err := db.ProjectStats(root)
+	if err != nil {
+		t.Fatalf("db.ProjectStats() returned error %v", err)
+	}
+	want := &ProjectStats{Packages: 3, Synopses: 1, Kinds: map[string]int{"p": 1, "c": 1, "d": 1}, Importers: 2}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("db.ProjectStats() = %+v, want %+v", stats, want)
+	}
+
+	stats, err = db.ProjectStats("github.com/user/missing")
+	if err != nil {
+		t.Fatalf("db.ProjectStats(missing) returned error %v", err)
+	}
+	if want := (&ProjectStats{Kinds: map[string]int{}}); !reflect.DeepEqual(stats, want) {
+		t.Errorf("db.ProjectStats(missing) = %+v, want %+v", stats, want)
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, path := range []string{"github.com/user/good", "github.com/user/bad"} {
+		if _, err := db.Put(&doc.Package{ImportPath: path, Name: "p"}, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", path, err)
+		}
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+	id, _ := redis.String(c.Do("HGET", "ids", "github.com/user/bad"))
+	c.Do("HSET", "pkg:"+id, "gob", "not a gob")
+
+	_, _, _, err := db.Get("github.com/user/bad")
+	if !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("db.Get(bad) returned error %v, want %v", err, ErrCorruptRecord)
+	}
+	if e, ok := err.(*CorruptRecordError); !ok || e.Path != "github.com/user/bad" || e.Err == nil {
+		t.Errorf("db.Get(bad) returned error %#v, want *CorruptRecordError for github.com/user/bad", err)
+	}
+
+	if err := db.Do(func(*PackageInfo) error { return nil }); err == nil {
+		t.Errorf("db.Do() returned nil error, want error")
+	}
+
+	var got []string
+	n, err := db.DoSkipCorrupt(func(pi *PackageInfo) error {
+		got = append(got, pi.PDoc.ImportPath)
+		return nil
+	})
+	if n != 1 || err != nil {
+		t.Errorf("db.DoSkipCorrupt() returned %d, %v, want 1, nil", n, err)
+	}
+	if want := []string{"github.com/user/good"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("db.DoSkipCorrupt() visited %v, want %v", got, want)
+	}
+}
+
+func TestDeleteWithTombstone(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	const path = "github.com/user/repo/gone"
+	if _, err := db.Put(&doc.Package{ImportPath: path}, time.Time{}); err != nil {
+		t.Fatalf("db.Put() returned error %v", err)
+	}
+	if err := db.DeleteWithTombstone(path, time.Microsecond); err == nil {
+		t.Errorf("db.DeleteWithTombstone() with short ttl returned nil error")
+	}
+	if ok, err := db.Exists(path); !ok || err != nil {
+		t.Errorf("db.Exists(%q) after failed delete returned %v, %v, want true, nil", path, ok, err)
+	}
+	if err := db.DeleteWithTombstone(path, time.Hour); err != nil {
+		t.Fatalf("db.DeleteWithTombstone() returned error %v", err)
+	}
+	if pdoc, _, err := db.GetDoc(path); pdoc != nil || err != nil {
+		t.Errorf("db.GetDoc(%q) returned %v, %v, want nil, nil", path, pdoc, err)
+	}
+
+	for _, p := range []string{path, "github.com/user/repo/other"} {
+		if err := db.AddNewCrawl(p); err != nil {
+			t.Fatalf("db.AddNewCrawl(%q) returned error %v", p, err)
+		}
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+	paths, _ := redis.Strings(c.Do("SMEMBERS", "newCrawl"))
+	if want := []string{"github.com/user/repo/other"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("newCrawl = %v, want %v", paths, want)
+	}
+
+	if err := db.AddBadCrawl(path); err != nil {
+		t.Fatalf("db.AddBadCrawl() returned error %v", err)
+	}
+	if n, err := db.RetryBadCrawls(); n != 0 || err != nil {
+		t.Errorf("db.RetryBadCrawls() returned %d, %v, want 0, nil", n, err)
+	}
+}
+
+func TestDeleteProject(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, path := range []string{"github.com/user/repo", "github.com/user/repo/a", "github.com/user/other"} {
+		root := path
+		if root != "github.com/user/other" {
+			root = "github.com/user/repo"
+		}
+		if _, err := db.Put(&doc.Package{ImportPath: path, ProjectRoot: root}, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", path, err)
+		}
+	}
+
+	n, err := db.DeleteProject("github.com/user/repo")
+	if n != 2 || err != nil {
+		t.Errorf("db.DeleteProject() returned %d, %v, want 2, nil", n, err)
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+	paths, _ := redis.Strings(c.Do("HKEYS", "ids"))
+	if want := []string{"github.com/user/other"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("ids = %v, want %v", paths, want)
+	}
+
+	blocked, err := db.IsBlocked("github.com/user/repo/a")
+	if blocked || err != nil {
+		t.Errorf("db.IsBlocked() returned %v, %v, want false, nil", blocked, err)
+	}
+}
+
+func TestQueryStem(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	pdoc := &doc.Package{
+		ImportPath: "github.com/user/idx",
+		Name:       "idx",
+		Synopsis:   "Package idx is for indexing documents.",
+		Funcs:      []*doc.Func{{}},
+	}
+	if _, err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatalf("db.Put() returned error %v", err)
+	}
+	for _, q := range []string{"indexed", "indexes", "document"} {
+		pkgs, err := db.Query(q)
+		if len(pkgs) != 1 || err != nil {
+			t.Errorf("db.Query(%q) returned %v, %v, want 1 package, nil", q, pkgs, err)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/user/repo", Name: "repo"},
+		{ImportPath: "github.com/user/repo/cmd", Name: "main", IsCmd: true},
+		{ImportPath: "github.com/user/repo/dir"},
+	} {
+		if _, err := db.Put(pdoc, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+	if err := db.AddBadCrawl("github.com/user/bad"); err != nil {
+		t.Fatalf("db.AddBadCrawl() returned error %v", err)
+	}
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatalf("db.Stats() returned error %v", err)
+	}
+	size := stats.Size
+	stats.Size = 0
+	want := &Stats{
+		Packages:  3,
+		Kinds:     map[string]int{"p": 1, "c": 1, "d": 1},
+		NewCrawl:  0,
+		BadCrawl:  1,
+		NextCrawl: 3,
+	}
+	if !reflect.DeepEqual(stats, want) || size == 0 {
+		t.Errorf("db.Stats() = %+v with size %d, want %+v with size > 0", stats, size, want)
+	}
+}
+
+func TestGetDocIfChanged(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	const path = "github.com/user/repo"
+	nextCrawl := time.Unix(time.Now().Add(time.Hour).Unix(), 0).UTC()
+	if _, err := db.Put(&doc.Package{ImportPath: path, Etag: "a"}, nextCrawl); err != nil {
+		t.Fatalf("db.Put() returned error %v", err)
+	}
+
+	pdoc, tc, changed, err := db.GetDocIfChanged(path, "a")
+	if pdoc != nil || !tc.Equal(nextCrawl) || changed || err != nil {
+		t.Errorf("db.GetDocIfChanged(%q, \"a\") returned %v, %v, %v, %v, want nil, %v, false, nil", path, pdoc, tc, changed, err, nextCrawl)
+	}
+
+	pdoc, tc, changed, err = db.GetDocIfChanged(path, "b")
+	if pdoc == nil || pdoc.Etag != "a" || !tc.Equal(nextCrawl) || !changed || err != nil {
+		t.Errorf("db.GetDocIfChanged(%q, \"b\") returned %v, %v, %v, %v, want package, %v, true, nil", path, pdoc, tc, changed, err, nextCrawl)
+	}
+
+	pdoc, _, changed, err = db.GetDocIfChanged("github.com/user/missing", "a")
+	if pdoc != nil || !changed || err != nil {
+		t.Errorf("db.GetDocIfChanged(missing) returned %v, %v, %v, want nil, true, nil", pdoc, changed, err)
+	}
+}
+
+func TestQueryKind(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/user/httpd", Name: "main", IsCmd: true, Synopsis: "Httpd is an http server."},
+		{ImportPath: "github.com/user/httputil", Name: "httputil", Synopsis: "Package httputil is for http servers.", Funcs: []*doc.Func{{}}},
+	} {
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+
+	for q, want := range map[string][]string{
+		"http":                    {"github.com/user/httputil"},
+		"http is:command":         {"github.com/user/httpd"},
+		"http is:package":         {"github.com/user/httputil"},
+		"server is:command":       {"github.com/user/httpd"},
+		"http -server is:command": nil,
+	} {
+		pkgs, err := db.Query(q)
+		if err != nil {
+			t.Fatalf("db.Query(%q) returned error %v", q, err)
+		}
+		var got []string
+		for _, pkg := range pkgs {
+			got = append(got, pkg.Path)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("db.Query(%q) = %v, want %v", q, got, want)
+		}
+	}
+
+	// Changing the kind moves the package to the new kind set.
+	if _, err := db.Put(&doc.Package{ImportPath: "github.com/user/httpd"}, time.Time{}); err != nil {
+		t.Fatalf("db.Put() returned error %v", err)
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	n, err := redis.Int(c.Do("SCARD", "index:kind:c"))
+	if n != 0 || err != nil {
+		t.Errorf("SCARD index:kind:c returned %d, %v, want 0, nil", n, err)
+	}
+}
+
+func TestWeightCrawlTime(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	for _, tt := range []struct {
+		d    time.Duration
+		n    int
+		want time.Duration
+	}{
+		{24 * time.Hour, 0, 24 * time.Hour},
+		{24 * time.Hour, 100, 12 * time.Hour},
+		{24 * time.Hour, 300, 6 * time.Hour},
+		{24 * time.Hour, 100000, minCrawlInterval},
+		{30 * time.Minute, 100, 30 * time.Minute},
+	} {
+		if got := weightCrawlTime(now, now.Add(tt.d), tt.n).Sub(now); got != tt.want {
+			t.Errorf("weightCrawlTime(now, now+%v, %d) = now+%v, want now+%v", tt.d, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestBumpCrawlWeighted(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	*crawlWeighted = true
+	defer func() { *crawlWeighted = false }()
+
+	const root = "github.com/user/repo"
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: root + "/a", ProjectRoot: root},
+		{ImportPath: root + "/b", ProjectRoot: root},
+		{ImportPath: "github.com/other/x", ProjectRoot: "github.com/other/x", Imports: []string{root + "/b"}},
+	} {
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+	if err := db.BumpCrawl(root); err != nil {
+		t.Fatalf("db.BumpCrawl() returned error %v", err)
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+	paths, err := redis.Strings(c.Do("SORT", "nextCrawl", "BY", "nosort", "GET", "pkg:*->path"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SORT BY nosort on a zset returns the members in score order.
+	if want := []string{root + "/b", root + "/a"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("crawl order = %v, want %v", paths, want)
+	}
+}
+
+func TestPutBatchWeighted(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	*crawlWeighted = true
+	defer func() { *crawlWeighted = false }()
+
+	importer := &doc.Package{ImportPath: "github.com/other/x", Imports: []string{"github.com/user/a", "github.com/user/b"}}
+	if _, err := db.Put(importer, time.Time{}); err != nil {
+		t.Fatalf("db.Put() returned error %v", err)
+	}
+
+	nextCrawl := time.Now().Add(24 * time.Hour)
+	if _, err := db.Put(&doc.Package{ImportPath: "github.com/user/a"}, nextCrawl); err != nil {
+		t.Fatalf("db.Put() returned error %v", err)
+	}
+	if err := db.PutBatch([]*doc.Package{{ImportPath: "github.com/user/b"}}, nextCrawl); err != nil {
+		t.Fatalf("db.PutBatch() returned error %v", err)
+	}
+
+	var times []time.Time
+	for _, path := range []string{"github.com/user/a", "github.com/user/b"} {
+		_, crawl, err := db.GetDoc(path)
+		if err != nil {
+			t.Fatalf("db.GetDoc(%q) returned error %v", path, err)
+		}
+		if !crawl.Before(nextCrawl.Add(-time.Minute)) {
+			t.Errorf("crawl time for %s is %v, want weighted time before %v", path, crawl, nextCrawl)
+		}
+		times = append(times, crawl)
+	}
+	if d := times[0].Sub(times[1]); d < -time.Second || d > time.Second {
+		t.Errorf("Put crawl time %v and PutBatch crawl time %v differ", times[0], times[1])
+	}
+}
+
+func TestImportGraphDOT(t *testing.T) {
+	nodes := []Package{
+		{Path: "github.com/user/repo", Synopsis: `Package repo is "quoted".`},
+		{Path: "fmt", Synopsis: "Package fmt formats."},
+		{Path: "github.com/user/dep"},
+	}
+	edges := [][2]int{{0, 1}, {0, 2}, {2, 1}}
+	got := string(ImportGraphDOT(nodes, edges))
+	want := `digraph G {
+ n0 [label="github.com/user/repo", URL="/github.com/user/repo", tooltip="Package repo is \"quoted\".", style=filled, fillcolor=lightgray];
+ n2 [label="github.com/user/dep", URL="/github.com/user/dep", tooltip=""];
+ subgraph cluster_std {
+  label="standard library";
+  n1 [label="fmt", URL="/fmt", tooltip="Package fmt formats."];
+ }
+ n0 -> n1;
+ n0 -> n2;
+ n2 -> n1;
+}
+`
+	if got != want {
+		t.Errorf("ImportGraphDOT() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestImporterCounts(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/user/a", Imports: []string{"github.com/user/b", "github.com/user/c"}},
+		{ImportPath: "github.com/user/d", Imports: []string{"github.com/user/b"}},
+	} {
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+
+	counts, err := db.ImporterCounts([]string{"github.com/user/b", "github.com/user/c", "github.com/user/missing"})
+	want := map[string]int{"github.com/user/b": 2, "github.com/user/c": 1, "github.com/user/missing": 0}
+	if !reflect.DeepEqual(counts, want) || err != nil {
+		t.Errorf("db.ImporterCounts() returned %v, %v, want %v, nil", counts, err, want)
+	}
+}
+
+func TestEachPackage(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	var want []string
+	for i := 0; i < eachPackageChunk+2; i++ {
+		path := "github.com/user/p" + strconv.Itoa(i)
+		pdoc := &doc.Package{ImportPath: path, Name: "p"}
+		if i%100 == 0 {
+			pdoc.Name = ""
+		} else {
+			want = append(want, path)
+		}
+		if _, err := db.Put(pdoc, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", path, err)
+		}
+	}
+
+	var got []string
+	err := db.EachPackage(func(pkg Package) error {
+		got = append(got, pkg.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("db.EachPackage() returned error %v", err)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("db.EachPackage() visited %d packages, want %d", len(got), len(want))
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+
+	stop := errors.New("stop")
+	n := 0
+	err = db.EachPackage(func(pkg Package) error {
+		n++
+		// The temporary list expires if the iteration is abandoned.
+		keys, _ := redis.Strings(c.Do("KEYS", "tmp:*"))
+		if len(keys) != 1 {
+			t.Fatalf("temporary keys = %v, want one list", keys)
+		}
+		if ttl, _ := redis.Int(c.Do("TTL", keys[0])); ttl <= 0 {
+			t.Errorf("TTL(%s) = %d, want > 0", keys[0], ttl)
+		}
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("db.EachPackage() with error returned %v after %d calls, want %v after 1 call", err, n, stop)
+	}
+
+	if keys, _ := redis.Strings(c.Do("KEYS", "tmp:*")); len(keys) != 0 {
+		t.Errorf("temporary keys %v remain after db.EachPackage()", keys)
+	}
+}
+
+func TestDo(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	want := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		path := "github.com/user/p" + strconv.Itoa(i)
+		if _, err := db.Put(&doc.Package{ImportPath: path, Name: "p", Synopsis: "Package p."}, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", path, err)
+		}
+		want[path] = true
+	}
+
+	got := map[string]bool{}
+	err := db.Do(func(pi *PackageInfo) error {
+		if got[pi.PDoc.ImportPath] {
+			t.Errorf("db.Do() called f more than once for %s", pi.PDoc.ImportPath)
+		}
+		got[pi.PDoc.ImportPath] = true
+		if min := len(pi.PDoc.ImportPath) + len(pi.PDoc.Synopsis); pi.Size <= min {
+			t.Errorf("PackageInfo.Size = %d for %s, want > %d", pi.Size, pi.PDoc.ImportPath, min)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("db.Do() returned error %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("db.Do() visited %v, want %v", got, want)
+	}
+}
+
+func TestRelated(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, pdoc := range []*doc.Package{
+		{ImportPath: "github.com/user/b", Name: "b", Synopsis: "Package b."},
+		{ImportPath: "github.com/user/x", Imports: []string{"github.com/user/a", "github.com/user/b", "github.com/user/c", "fmt"}},
+		{ImportPath: "github.com/user/y", Imports: []string{"github.com/user/a", "github.com/user/b", "fmt"}},
+		{ImportPath: "github.com/user/z", Imports: []string{"github.com/user/c", "github.com/user/d"}},
+	} {
+		if _, err := db.Put(pdoc, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", pdoc.ImportPath, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		count int
+		want  []Package
+	}{
+		{10, []Package{{Path: "github.com/user/b", Synopsis: "Package b.", Kind: "p"}, {Path: "github.com/user/c", Kind: "u"}}},
+		{1, []Package{{Path: "github.com/user/b", Synopsis: "Package b.", Kind: "p"}}},
+	} {
+		pkgs, err := db.Related("github.com/user/a", tt.count)
+		if !reflect.DeepEqual(pkgs, tt.want) || err != nil {
+			t.Errorf("db.Related(a, %d) returned %v, %v, want %v, nil", tt.count, pkgs, err, tt.want)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+	if err := db.Ping(); err != nil {
+		t.Fatalf("db.Ping() returned error %v", err)
+	}
+}
+
+func TestGetContext(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	pdoc := &doc.Package{ImportPath: "github.com/user/repo/foo", Name: "foo"}
+	if _, err := db.Put(pdoc, time.Time{}); err != nil {
+		t.Fatalf("db.Put() returned error %v", err)
+	}
+
+	actual, _, _, err := db.GetContext(context.Background(), pdoc.ImportPath)
+	if err != nil {
+		t.Fatalf("db.GetContext() returned error %v", err)
+	}
+	if actual == nil || actual.ImportPath != pdoc.ImportPath {
+		t.Fatalf("db.GetContext() returned %+v, want %s", actual, pdoc.ImportPath)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, _, err := db.GetContext(ctx, pdoc.ImportPath); err != context.Canceled {
+		t.Fatalf("db.GetContext() with canceled context returned error %v, want %v", err, context.Canceled)
+	}
+
+	// GetContext uses connections from the pool.
+	dials := 0
+	pooled := &Database{Pool: &redis.Pool{MaxIdle: 1, Dial: func() (redis.Conn, error) {
+		dials++
+		c, err := redis.Dial("tcp", ":6379")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.Do("SELECT", "9"); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}}}
+	for i := 0; i < 2; i++ {
+		if actual, _, _, err := pooled.GetContext(context.Background(), pdoc.ImportPath); actual == nil || err != nil {
+			t.Fatalf("db.GetContext() returned %v, %v, want package", actual, err)
+		}
+	}
+	if dials != 1 {
+		t.Errorf("db.GetContext() dialed %d connections, want 1", dials)
+	}
+
+	// A server that never replies.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	hung := &Database{Pool: &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", l.Addr().String()) }}}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, _, err := hung.GetContext(ctx, pdoc.ImportPath); err != context.DeadlineExceeded {
+		t.Fatalf("db.GetContext() on hung server returned error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+type testObserver []string
+
+func (o *testObserver) ObserveOp(name string, dur time.Duration, err error) {
+	*o = append(*o, name)
+}
+
+func TestObserver(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	var o testObserver
+	db.Observer = &o
+
+	if _, err := db.Exists("github.com/user/repo"); err != nil {
+		t.Fatalf("db.Exists() returned error %v", err)
+	}
+	if _, err := db.QueryCount("foo"); err != nil {
+		t.Fatalf("db.QueryCount() returned error %v", err)
+	}
+	if _, err := db.Index(); err != nil {
+		t.Fatalf("db.Index() returned error %v", err)
+	}
+	if _, err := db.Importers("github.com/user/repo"); err != nil {
+		t.Fatalf("db.Importers() returned error %v", err)
+	}
+	expected := testObserver{"Exists", "QueryCount", "QueryCount", "Index", "Importers", "Importers"}
+	if !reflect.DeepEqual(o, expected) {
+		t.Errorf("observed %v, want %v", o, expected)
+	}
+}
+
 const epsilon = 0.000001
 
 func TestPopular(t *testing.T) {
@@ -235,6 +1893,87 @@ func TestPopular(t *testing.T) {
 	}
 }
 
+func TestPopularWindow(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	for _, path := range []string{"github.com/user/old", "github.com/user/new"} {
+		if _, err := db.Put(&doc.Package{ImportPath: path, Name: path[len("github.com/user/"):]}, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", path, err)
+		}
+	}
+
+	// The old package has more hits, but the hits are three days old.
+	now := time.Now()
+	if err := db.incrementPopularScoreInternal("github.com/user/old", 4, now.Add(-72*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.incrementPopularScoreInternal("github.com/user/new", 1, now); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		window time.Duration
+		first  string
+	}{
+		{popularHalfLife, "github.com/user/old"},
+		{30 * time.Hour, "github.com/user/new"},
+	} {
+		pkgs, err := db.PopularWindow(tt.window, 2)
+		if err != nil {
+			t.Fatalf("db.PopularWindow(%v) returned error %v", tt.window, err)
+		}
+		if len(pkgs) != 2 || pkgs[0].Path != tt.first {
+			t.Errorf("db.PopularWindow(%v) = %v, want first %s", tt.window, pkgs, tt.first)
+		}
+	}
+}
+
+func TestResetPopularScore(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(db)
+
+	now := time.Now()
+	for i, name := range []string{"a", "b", "c"} {
+		path := "github.com/user/" + name
+		if _, err := db.Put(&doc.Package{ImportPath: path, Name: name}, time.Time{}); err != nil {
+			t.Fatalf("db.Put(%q) returned error %v", path, err)
+		}
+		if err := db.incrementPopularScoreInternal(path, float64(i+1), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.ResetPopularScore("github.com/user/b"); err != nil {
+		t.Fatalf("db.ResetPopularScore() returned error %v", err)
+	}
+	for _, w := range popularWindows {
+		pkgs, err := db.PopularWindow(w.halfLife, 10)
+		if err != nil {
+			t.Fatalf("db.PopularWindow(%v) returned error %v", w.halfLife, err)
+		}
+		var paths []string
+		for _, pkg := range pkgs {
+			paths = append(paths, pkg.Path)
+		}
+		if want := []string{"github.com/user/c", "github.com/user/a"}; !reflect.DeepEqual(paths, want) {
+			t.Errorf("db.PopularWindow(%v) after reset = %v, want %v", w.halfLife, paths, want)
+		}
+	}
+
+	if err := db.ResetAllPopularScores(); err != nil {
+		t.Fatalf("db.ResetAllPopularScores() returned error %v", err)
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	for _, w := range popularWindows {
+		n, err := redis.Int(c.Do("EXISTS", w.key, w.key+":0"))
+		if n != 0 || err != nil {
+			t.Errorf("EXISTS %s %s:0 after reset all returned %d, %v, want 0, nil", w.key, w.key, n, err)
+		}
+	}
+}
+
 func TestCounter(t *testing.T) {
 	db := newDB(t)
 	defer closeDB(db)
@@ -264,4 +2003,23 @@ func TestCounter(t *testing.T) {
 	if math.Abs(n-2.0)/2.0 > epsilon {
 		t.Errorf("3: got n=%g, want 2", n)
 	}
+	now = now.Add(counterHalflife)
+	n, err = db.getCounterInternal(key, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(n-1.0) > epsilon {
+		t.Errorf("4: got n=%g, want 1", n)
+	}
+	n, err = db.getCounterInternal("missing", now)
+	if n != 0 || err != nil {
+		t.Errorf("missing: got n=%g, err=%v, want 0, nil", n, err)
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+	ttl, err := redis.Int64(c.Do("TTL", "counter:"+key))
+	if want := int64(counterExpire / time.Second); ttl <= 0 || ttl > want || err != nil {
+		t.Errorf("TTL counter:%s returned %d, %v, want %d, nil", key, ttl, err, want)
+	}
 }
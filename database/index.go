@@ -15,10 +15,13 @@
 package database
 
 import (
+	"bytes"
+	"html"
 	"path"
 	"regexp"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/garyburd/gddo/doc"
 	"github.com/garyburd/gosrc"
@@ -39,8 +42,32 @@ func normalizeProjectRoot(projectRoot string) string {
 	return projectRoot
 }
 
+const (
+	minSuggestPrefix = 2
+	maxSuggestPrefix = 4
+)
+
+// suggestPrefix returns the lower case prefix of s with n runes or "" if s
+// is shorter than n runes.
+func suggestPrefix(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return strings.ToLower(s[:i])
+		}
+		n--
+	}
+	if n == 0 {
+		return strings.ToLower(s)
+	}
+	return ""
+}
+
 var httpPat = regexp.MustCompile(`https?://\S+`)
 
+// commandTermPrefix is the prefix of the text and filter terms for commands.
+// See sendIntersect.
+const commandTermPrefix = "cmd:"
+
 func documentTerms(pdoc *doc.Package, score float64) []string {
 
 	terms := make(map[string]bool)
@@ -62,29 +89,103 @@ func documentTerms(pdoc *doc.Package, score float64) []string {
 		}
 	}
 
-	if score > 0 {
+	// Commands are not ranked. Their terms are indexed with commandTermPrefix
+	// so that commands are only found with the is:command filter.
+	if score > 0 || pdoc.IsCmd {
+		t := terms
+		if pdoc.IsCmd {
+			t = make(map[string]bool)
+		}
 
 		if isStandardPackage(pdoc.ImportPath) {
 			for _, term := range parseQuery(pdoc.ImportPath) {
-				terms[term] = true
+				t[term] = true
 			}
 		} else {
-			terms["all:"] = true
+			if score > 0 {
+				t["all:"] = true
+			}
 			for _, term := range parseQuery(pdoc.ProjectName) {
-				terms[term] = true
+				t[term] = true
 			}
 			for _, term := range parseQuery(pdoc.Name) {
-				terms[term] = true
+				t[term] = true
+			}
+		}
+
+		// License
+
+		if pdoc.License != "" {
+			t["license:"+strings.ToLower(pdoc.License)] = true
+		} else {
+			t["license:none"] = true
+		}
+
+		// Deprecation. The -is:deprecated filter subtracts this set.
+
+		if pdoc.Deprecated {
+			t["deprecated:yes"] = true
+		}
+
+		// Platforms
+
+		hasOS, hasArch := false, false
+		for _, p := range pdoc.Platforms {
+			t["platform:"+p] = true
+			if doc.IsKnownOS(p) {
+				hasOS = true
+			} else {
+				hasArch = true
+			}
+		}
+		switch {
+		case !hasOS && !hasArch:
+			t["platform:all"] = true
+		case !hasOS:
+			t["platform:allos"] = true
+		case !hasArch:
+			t["platform:allarch"] = true
+		}
+
+		// Suggestions
+
+		for n := minSuggestPrefix; n <= maxSuggestPrefix; n++ {
+			if p := suggestPrefix(path.Base(pdoc.ImportPath), n); p != "" {
+				t["suggest:"+p] = true
 			}
 		}
 
 		// Synopsis
 
 		synopsis := httpPat.ReplaceAllLiteralString(pdoc.Synopsis, "")
-		for i, s := range strings.FieldsFunc(synopsis, isTermSep) {
-			s = strings.ToLower(s)
-			if !stopWord[s] && (i > 3 || s != "package") {
-				terms[stem(s)] = true
+		addTextTerms(t, synopsis)
+		for _, term := range phraseTerms(synopsis) {
+			t[term] = true
+		}
+
+		// Documentation. These terms have weight 1 in documentTermWeights,
+		// so they widen the set of matches without boosting the rank.
+
+		if *indexDoc {
+			addTextTerms(t, httpPat.ReplaceAllLiteralString(pdoc.Doc, ""))
+		}
+		if *indexDeclDoc {
+			for _, d := range declDocs(pdoc) {
+				addTextTerms(t, httpPat.ReplaceAllLiteralString(d, ""))
+			}
+		}
+
+		// Exported identifiers
+
+		for _, name := range identifiers(pdoc, *indexMethods) {
+			if isIndexWord(name) {
+				t[stem(strings.ToLower(name))] = true
+			}
+		}
+
+		if pdoc.IsCmd {
+			for term := range t {
+				terms[commandTermPrefix+term] = true
 			}
 		}
 	}
@@ -96,12 +197,130 @@ func documentTerms(pdoc *doc.Package, score float64) []string {
 	return result
 }
 
+const (
+	synopsisTermWeight = 3
+	nameTermWeight     = 2
+)
+
+// documentTermWeights returns the weights of the terms that rank a package
+// higher when they match a query. Terms not in the map, such as the project
+// name or documentation terms, have weight 1. A term in both the synopsis
+// and the package name gets the boost of both.
+func documentTermWeights(pdoc *doc.Package, score float64) map[string]float64 {
+	if score <= 0 {
+		return nil
+	}
+	weights := make(map[string]float64)
+	terms := make(map[string]bool)
+	addTextTerms(terms, httpPat.ReplaceAllLiteralString(pdoc.Synopsis, ""))
+	for term := range terms {
+		weights[term] = synopsisTermWeight
+	}
+	name := pdoc.Name
+	if isStandardPackage(pdoc.ImportPath) {
+		name = pdoc.ImportPath
+	}
+	for _, term := range parseQuery(name) {
+		if w, ok := weights[term]; ok {
+			weights[term] = w + nameTermWeight - 1
+		} else {
+			weights[term] = nameTermWeight
+		}
+	}
+	return weights
+}
+
+// isIndexWord returns false for words that are too long or do not contain a
+// letter. These words are not indexed or used in queries.
+func isIndexWord(s string) bool {
+	if utf8.RuneCountInString(s) > *maxTermRunes {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsLetter(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// addTextTerms adds the stemmed words of text to terms. A leading "package"
+// is skipped because most package documentation starts with it.
+func addTextTerms(terms map[string]bool, text string) {
+	for i, s := range strings.FieldsFunc(text, isTermSep) {
+		s = strings.ToLower(s)
+		if !stopWord[s] && isIndexWord(s) && (i > 3 || s != "package") {
+			terms[stem(s)] = true
+		}
+	}
+}
+
+// identifiers returns the names of the top-level functions and types in
+// pdoc, including the functions grouped with a type. Method names are
+// included if methods is true.
+func identifiers(pdoc *doc.Package, methods bool) []string {
+	var names []string
+	for _, f := range pdoc.Funcs {
+		names = append(names, f.Name)
+	}
+	for _, t := range pdoc.Types {
+		names = append(names, t.Name)
+		for _, f := range t.Funcs {
+			names = append(names, f.Name)
+		}
+		if methods {
+			for _, f := range t.Methods {
+				names = append(names, f.Name)
+			}
+		}
+	}
+	return names
+}
+
+// declDocs returns the doc comments of the exported declarations in pdoc.
+func declDocs(pdoc *doc.Package) []string {
+	var docs []string
+	for _, v := range pdoc.Consts {
+		docs = append(docs, v.Doc)
+	}
+	for _, v := range pdoc.Vars {
+		docs = append(docs, v.Doc)
+	}
+	for _, f := range pdoc.Funcs {
+		docs = append(docs, f.Doc)
+	}
+	for _, t := range pdoc.Types {
+		docs = append(docs, t.Doc)
+		for _, v := range t.Consts {
+			docs = append(docs, v.Doc)
+		}
+		for _, v := range t.Vars {
+			docs = append(docs, v.Doc)
+		}
+		for _, f := range t.Funcs {
+			docs = append(docs, f.Doc)
+		}
+		for _, f := range t.Methods {
+			docs = append(docs, f.Doc)
+		}
+	}
+	return docs
+}
+
+// isVendorOrInternal returns true if the path below the project root has a
+// vendor or internal element between other elements. These packages are
+// stored, but not ranked.
+func isVendorOrInternal(path string) bool {
+	return strings.Contains(path, "/vendor/") || strings.Contains(path, "/internal/")
+}
+
 func documentScore(pdoc *doc.Package) float64 {
 	if pdoc.Name == "" ||
 		pdoc.IsCmd ||
 		len(pdoc.Errors) > 0 ||
 		strings.HasSuffix(pdoc.ImportPath, ".go") ||
-		strings.HasPrefix(pdoc.ImportPath, "gist.github.com/") {
+		strings.HasPrefix(pdoc.ImportPath, "gist.github.com/") ||
+		isVendorOrInternal(pdoc.ImportPath[len(pdoc.ProjectRoot):]) {
 		return 0
 	}
 
@@ -151,16 +370,216 @@ func documentScore(pdoc *doc.Package) float64 {
 		r *= 0.9
 	}
 
+	if pdoc.Deprecated {
+		r *= 0.5
+	}
+
 	return r
 }
 
+// phraseTerms returns a phrase term for each pair of adjacent words in s.
+// Stop words are removed before pairing and the words are not stemmed. The
+// same function is used for documents and queries so that the terms agree.
+func phraseTerms(s string) []string {
+	var words []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(s), isTermSep) {
+		if !stopWord[w] && isIndexWord(w) {
+			words = append(words, w)
+		}
+	}
+	var terms []string
+	for i := 1; i < len(words); i++ {
+		terms = append(terms, "phrase:"+words[i-1]+"-"+words[i])
+	}
+	return terms
+}
+
+// highlightStems returns the stems of the words in the query terms. Filter
+// and negated terms are ignored and phrase terms contribute both of their
+// words.
+func highlightStems(terms []string) map[string]bool {
+	stems := make(map[string]bool)
+	for _, term := range terms {
+		switch {
+		case strings.HasPrefix(term, "phrase:"):
+			for _, w := range strings.Split(term[len("phrase:"):], "-") {
+				stems[stem(w)] = true
+			}
+		case strings.Index(term, ":") < 0 && !strings.HasPrefix(term, "-"):
+			stems[term] = true
+		}
+	}
+	return stems
+}
+
+// highlight returns s as HTML with the words that stem to one of stems
+// wrapped in <mark> elements.
+func highlight(s string, stems map[string]bool) string {
+	var buf bytes.Buffer
+	last := 0
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if isTermSep(r) {
+			i += size
+			continue
+		}
+		j := i + size
+		for j < len(s) {
+			r, size := utf8.DecodeRuneInString(s[j:])
+			if isTermSep(r) {
+				break
+			}
+			j += size
+		}
+		if stems[stem(strings.ToLower(s[i:j]))] {
+			buf.WriteString(html.EscapeString(s[last:i]))
+			buf.WriteString("<mark>")
+			buf.WriteString(html.EscapeString(s[i:j]))
+			buf.WriteString("</mark>")
+			last = j
+		}
+		i = j
+	}
+	buf.WriteString(html.EscapeString(s[last:]))
+	return buf.String()
+}
+
+// queryFilters is the set of query words that filter results by an indexed
+// attribute. The word "license:mit" is converted to the term "license:mit".
+// A project: word for a root that is not indexed is a path prefix filter. See
+// scopeTerms.
+var queryFilters = []string{"license:", "platform:", "project:"}
+
+// wordFilters maps query words to the terms for the package kind sets
+// maintained by putScript and the deprecation term. A negated word such as
+// -is:deprecated excludes the packages with the term.
+var wordFilters = map[string]string{
+	"is:command":    "kind:c",
+	"is:package":    "kind:p",
+	"is:deprecated": "deprecated:yes",
+}
+
+func filterTerm(s string) string {
+	if term, ok := wordFilters[s]; ok {
+		return term
+	}
+	for _, prefix := range queryFilters {
+		if strings.HasPrefix(s, prefix) && len(s) > len(prefix) {
+			return s
+		}
+	}
+	return ""
+}
+
 func parseQuery(q string) []string {
 	var terms []string
 	q = strings.ToLower(q)
-	for _, s := range strings.FieldsFunc(q, isTermSep) {
-		if !stopWord[s] {
-			terms = append(terms, stem(s))
+
+	// Text between double quotes is a phrase. The text following an
+	// unbalanced quote is handled as ordinary words.
+	parts := strings.Split(q, `"`)
+	for i, part := range parts {
+		if i%2 == 1 && i != len(parts)-1 {
+			if pt := phraseTerms(part); len(pt) > 0 {
+				terms = append(terms, pt...)
+				continue
+			}
+		}
+		for _, f := range strings.Fields(part) {
+			if term := filterTerm(f); term != "" {
+				terms = append(terms, term)
+				continue
+			}
+			neg := ""
+			if len(f) > 1 && f[0] == '-' {
+				// A leading '-' excludes the packages matching the word.
+				neg = "-"
+				f = f[1:]
+				if term := filterTerm(f); term != "" {
+					terms = append(terms, neg+term)
+					continue
+				}
+			}
+			for _, s := range strings.FieldsFunc(f, isTermSep) {
+				if !stopWord[s] && isIndexWord(s) {
+					terms = append(terms, neg+stem(s))
+				}
+			}
 		}
 	}
-	return terms
+
+	// There is nothing to exclude from if all terms are negated.
+	for _, term := range terms {
+		if !strings.HasPrefix(term, "-") {
+			return terms
+		}
+	}
+	return nil
+}
+
+// isOneEdit returns true if b is obtained from a by inserting, deleting or
+// substituting exactly one rune.
+func isOneEdit(a, b string) bool {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) > len(rb) {
+		ra, rb = rb, ra
+	}
+	if len(rb)-len(ra) > 1 {
+		return false
+	}
+	i := 0
+	for i < len(ra) && ra[i] == rb[i] {
+		i++
+	}
+	if len(ra) == len(rb) {
+		if i == len(ra) {
+			return false
+		}
+		return string(ra[i+1:]) == string(rb[i+1:])
+	}
+	return string(ra[i:]) == string(rb[i+1:])
+}
+
+// correctWord returns the word w with the edit that changes the stem of w to
+// the term t applied. The term is returned if the edit is not in the part of
+// w kept by the stemmer.
+func correctWord(w, t string) string {
+	w = strings.ToLower(w)
+	s := stem(w)
+	// The stem is a+x+b and the term is a+y+b.
+	i := 0
+	for i < len(s) && i < len(t) && s[i] == t[i] {
+		i++
+	}
+	j := 0
+	for j < len(s)-i && j < len(t)-i && s[len(s)-1-j] == t[len(t)-1-j] {
+		j++
+	}
+	end := len(s) - j
+	if end > len(w) || w[:end] != s[:end] {
+		return t
+	}
+	return t[:len(t)-j] + w[end:]
+}
+
+// replaceWords returns s with each word w replaced with f(w). Words are
+// separated by the runes where isTermSep returns true.
+func replaceWords(s string, f func(string) string) string {
+	var buf []byte
+	start := -1
+	for i, r := range s {
+		if isTermSep(r) {
+			if start >= 0 {
+				buf = append(buf, f(s[start:i])...)
+				start = -1
+			}
+			buf = append(buf, string(r)...)
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		buf = append(buf, f(s[start:])...)
+	}
+	return string(buf)
 }
@@ -18,6 +18,7 @@ import (
 	"github.com/garyburd/gddo/doc"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 )
 
@@ -36,23 +37,37 @@ var indexTests = []struct {
 		Funcs:       []*doc.Func{{}},
 	},
 		[]string{
-			"bas",
-			"convert",
-			"dat",
+			"basic",
+			"convers",
+			"data",
 			"import:errors",
 			"import:math",
 			"import:unicode/utf8",
+			"license:none",
+			"phrase:basic-data",
+			"phrase:conversions-string",
+			"phrase:data-types",
+			"phrase:package-strconv",
+			"phrase:representations-basic",
+			"phrase:strconv-conversions",
+			"phrase:string-representations",
+			"platform:all",
 			"project:go",
-			"repres",
+			"represent",
 			"strconv",
 			"string",
-			"typ"},
+			"suggest:st",
+			"suggest:str",
+			"suggest:strc",
+			"type"},
 	},
 	{&doc.Package{
 		ImportPath:  "github.com/user/repo/dir",
 		ProjectRoot: "github.com/user/repo",
 		ProjectName: "go-oauth",
 		ProjectURL:  "https://github.com/user/repo/",
+		License:     "BSD-3-Clause",
+		Platforms:   []string{"linux", "windows"},
 		Name:        "dir",
 		Synopsis:    "Package dir implements a subset of the OAuth client interface as defined in RFC 5849.",
 		Doc: "Package oauth implements a subset of the OAuth client interface as defined in RFC 5849.\n\n" +
@@ -84,13 +99,37 @@ var indexTests = []struct {
 	},
 		[]string{
 			"all:",
-			"5849", "cly", "defin", "dir", "go",
+			"client", "defin", "dir", "go",
 			"import:bytes", "import:crypto/hmac", "import:crypto/sha1",
 			"import:encoding/base64", "import:encoding/binary", "import:errors",
 			"import:fmt", "import:io", "import:io/ioutil", "import:net/http",
 			"import:net/url", "import:regexp", "import:sort", "import:strconv",
 			"import:strings", "import:sync", "import:time", "interfac",
-			"oau", "project:github.com/user/repo", "rfc", "subset",
+			"license:bsd-3-clause", "oauth", "phrase:client-interface", "phrase:defined-rfc",
+			"phrase:dir-subset", "phrase:interface-defined", "phrase:oauth-client",
+			"phrase:package-dir", "phrase:subset-oauth",
+			"platform:allarch", "platform:linux", "platform:windows", "project:github.com/user/repo", "rfc", "subset",
+			"suggest:di", "suggest:dir",
+		},
+	},
+	{&doc.Package{
+		ImportPath:  "github.com/user/repo/cmd/serve",
+		ProjectRoot: "github.com/user/repo",
+		Name:        "main",
+		IsCmd:       true,
+		Synopsis:    "Serve files.",
+	},
+		[]string{
+			"cmd:file",
+			"cmd:license:none",
+			"cmd:main",
+			"cmd:phrase:serve-files",
+			"cmd:platform:all",
+			"cmd:serv",
+			"cmd:suggest:se",
+			"cmd:suggest:ser",
+			"cmd:suggest:serv",
+			"project:github.com/user/repo",
 		},
 	},
 }
@@ -106,3 +145,246 @@ func TestDocTerms(t *testing.T) {
 		}
 	}
 }
+
+var parseQueryTests = []struct {
+	q     string
+	terms []string
+}{
+	{`foo bar`, []string{"foo", "bar"}},
+	{`"foo bar" baz`, []string{"phrase:foo-bar", "baz"}},
+	{`"net http client"`, []string{"phrase:net-http", "phrase:http-client"}},
+	{`"strings"`, []string{"string"}},
+	{`"foo bar`, []string{"foo", "bar"}},
+	{`"foo bar" "baz`, []string{"phrase:foo-bar", "baz"}},
+	{`http license:MIT`, []string{"http", "license:mit"}},
+	{`license:`, []string{"licens"}},
+	{`io platform:Windows`, []string{"io", "platform:windows"}},
+	{`http is:command`, []string{"http", "kind:c"}},
+	{`is:package`, []string{"kind:p"}},
+	{`http -is:deprecated`, []string{"http", "-deprecated:yes"}},
+	{`json -rpc`, []string{"json", "-rpc"}},
+	{`http -license:mit`, []string{"http", "-license:mit"}},
+	{`-rpc -http`, nil},
+	{`mux project:github.com/Gorilla/mux`, []string{"mux", "project:github.com/gorilla/mux"}},
+}
+
+func TestParseQuery(t *testing.T) {
+	for _, tt := range parseQueryTests {
+		terms := parseQuery(tt.q)
+		if !reflect.DeepEqual(terms, tt.terms) {
+			t.Errorf("parseQuery(%q)=%#v, want %#v", tt.q, terms, tt.terms)
+		}
+	}
+}
+
+var suggestPrefixTests = []struct {
+	s        string
+	n        int
+	expected string
+}{
+	{"Strconv", 2, "st"},
+	{"strconv", 4, "strc"},
+	{"dir", 4, ""},
+	{"dir", 3, "dir"},
+	{"über", 2, "üb"},
+}
+
+func TestSuggestPrefix(t *testing.T) {
+	for _, tt := range suggestPrefixTests {
+		actual := suggestPrefix(tt.s, tt.n)
+		if actual != tt.expected {
+			t.Errorf("suggestPrefix(%q, %d) = %q, want %q", tt.s, tt.n, actual, tt.expected)
+		}
+	}
+}
+
+var isOneEditTests = []struct {
+	a, b     string
+	expected bool
+}{
+	{"mongdb", "mongodb", true},
+	{"mongodb", "mongdb", true},
+	{"mongodb", "mongodc", true},
+	{"mongodb", "mongodb", false},
+	{"mongdb", "mongodbx", false},
+	{"", "a", true},
+	{"ab", "ba", false},
+}
+
+func TestIsOneEdit(t *testing.T) {
+	for _, tt := range isOneEditTests {
+		if actual := isOneEdit(tt.a, tt.b); actual != tt.expected {
+			t.Errorf("isOneEdit(%q, %q) = %v, want %v", tt.a, tt.b, actual, tt.expected)
+		}
+	}
+}
+
+func TestSetStopWords(t *testing.T) {
+	SetStopWords([]string{"Golang"})
+	defer delete(stopWord, "golang")
+
+	terms := parseQuery("golang http")
+	if want := []string{"http"}; !reflect.DeepEqual(terms, want) {
+		t.Errorf("parseQuery(\"golang http\") = %v, want %v", terms, want)
+	}
+}
+
+func TestDocTermsFullText(t *testing.T) {
+	defer func(d, dd bool) { *indexDoc, *indexDeclDoc = d, dd }(*indexDoc, *indexDeclDoc)
+
+	pdoc := &doc.Package{
+		ImportPath: "github.com/user/repo/dir",
+		Name:       "dir",
+		Synopsis:   "Package dir does things.",
+		Doc:        "Package dir does things. It is useful for walking trees.",
+		Funcs:      []*doc.Func{{Doc: "Walk visits each node."}},
+		Types:      []*doc.Type{{Methods: []*doc.Func{{Doc: "Prune removes branches."}}}},
+	}
+	has := func(terms []string, term string) bool {
+		for _, t := range terms {
+			if t == term {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		doc, declDoc bool
+		term         string
+		want         bool
+	}{
+		{false, false, "tree", false},
+		{true, false, "tree", true},
+		{true, false, "visit", false},
+		{false, true, "visit", true},
+		{false, true, "branch", true},
+	}
+	for _, tt := range tests {
+		*indexDoc, *indexDeclDoc = tt.doc, tt.declDoc
+		terms := documentTerms(pdoc, documentScore(pdoc))
+		if got := has(terms, tt.term); got != tt.want {
+			t.Errorf("doc=%v, declDoc=%v: has term %q = %v, want %v", tt.doc, tt.declDoc, tt.term, got, tt.want)
+		}
+	}
+}
+
+var highlightTests = []struct {
+	q, s, expected string
+}{
+	{"parse", "Package foo parses <config> files.", "Package foo <mark>parses</mark> &lt;config&gt; files."},
+	{"Config FILE", "Reads config files.", "Reads <mark>config</mark> <mark>files</mark>."},
+	{`"config files"`, "Config files.", "<mark>Config</mark> <mark>files</mark>."},
+	{"license:mit xyz", "Package foo.", "Package foo."},
+}
+
+func TestHighlight(t *testing.T) {
+	for _, tt := range highlightTests {
+		actual := highlight(tt.s, highlightStems(parseQuery(tt.q)))
+		if actual != tt.expected {
+			t.Errorf("highlight(%q, %q) = %q, want %q", tt.s, tt.q, actual, tt.expected)
+		}
+	}
+}
+
+var documentTermWeightsTests = []struct {
+	name, synopsis, term string
+	expected             float64
+}{
+	{"yaml", "Package yaml reads JSON files.", "json", synopsisTermWeight},
+	{"yaml", "Reads JSON files.", "yaml", nameTermWeight},
+	{"yaml", "Package yaml reads JSON files.", "yaml", synopsisTermWeight + nameTermWeight - 1},
+	{"yaml", "Package yaml reads JSON files.", "xml", 0},
+}
+
+func TestDocumentTermWeights(t *testing.T) {
+	for _, tt := range documentTermWeightsTests {
+		pdoc := &doc.Package{ImportPath: "github.com/user/" + tt.name, Name: tt.name, Synopsis: tt.synopsis}
+		if actual := documentTermWeights(pdoc, 1)[tt.term]; actual != tt.expected {
+			t.Errorf("documentTermWeights(%q, %q)[%q] = %v, want %v", tt.name, tt.synopsis, tt.term, actual, tt.expected)
+		}
+	}
+}
+
+var vendorOrInternalTests = []struct {
+	importPath, projectRoot string
+	expected                bool
+}{
+	{"github.com/user/repo/vendor/github.com/other/pkg", "github.com/user/repo", true},
+	{"github.com/user/repo/internal/util", "github.com/user/repo", true},
+	{"crypto/internal/subtle", "", true},
+	{"github.com/user/internal", "github.com/user/internal", false},
+	{"github.com/user/repo/internal", "github.com/user/repo", false},
+	{"github.com/internal/repo/pkg", "github.com/internal/repo", false},
+	{"github.com/user/repo/vendored/pkg", "github.com/user/repo", false},
+}
+
+func TestIsVendorOrInternal(t *testing.T) {
+	for _, tt := range vendorOrInternalTests {
+		pdoc := &doc.Package{ImportPath: tt.importPath, ProjectRoot: tt.projectRoot, Name: "p", Funcs: []*doc.Func{{}}}
+		if actual := isVendorOrInternal(tt.importPath[len(tt.projectRoot):]); actual != tt.expected {
+			t.Errorf("isVendorOrInternal(%q) = %v, want %v", tt.importPath, actual, tt.expected)
+		}
+		if score := documentScore(pdoc); (score == 0) != tt.expected {
+			t.Errorf("documentScore(%q) = %v", tt.importPath, score)
+		}
+	}
+}
+
+func TestDocTermsIdentifiers(t *testing.T) {
+	defer func(m bool) { *indexMethods = m }(*indexMethods)
+
+	pdoc := &doc.Package{
+		ImportPath: "github.com/user/ctx",
+		Name:       "ctx",
+		Funcs:      []*doc.Func{{Name: "WithCancel"}},
+		Types: []*doc.Type{{
+			Name:    "Context",
+			Funcs:   []*doc.Func{{Name: "Background"}},
+			Methods: []*doc.Func{{Name: "Deadline"}},
+		}},
+	}
+	for _, tt := range []struct {
+		methods bool
+		term    string
+		want    bool
+	}{
+		{false, "withcancel", true},
+		{false, "context", true},
+		{false, "background", true},
+		{false, "deadlin", false},
+		{true, "deadlin", true},
+	} {
+		*indexMethods = tt.methods
+		found := false
+		for _, term := range documentTerms(pdoc, documentScore(pdoc)) {
+			found = found || term == tt.term
+		}
+		if found != tt.want {
+			t.Errorf("methods=%v: has term %q = %v, want %v", tt.methods, tt.term, found, tt.want)
+		}
+	}
+
+	if terms := parseQuery("WithCancel"); !reflect.DeepEqual(terms, []string{"withcancel"}) {
+		t.Errorf("parseQuery(WithCancel) = %v, want [withcancel]", terms)
+	}
+}
+
+func TestDocTermsLongWord(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	pdoc := &doc.Package{
+		ImportPath: "github.com/user/blob",
+		Name:       "blob",
+		Synopsis:   "Package blob stores " + long + " 12345 data.",
+		Funcs:      []*doc.Func{{}},
+	}
+	terms := documentTerms(pdoc, documentScore(pdoc))
+	for _, term := range terms {
+		if strings.Contains(term, long) || strings.Contains(term, "12345") {
+			t.Errorf("documentTerms() returned term %q", term)
+		}
+	}
+	if q := parseQuery("stores " + long + " 12345"); !reflect.DeepEqual(q, []string{"store"}) {
+		t.Errorf("parseQuery() = %v, want [store]", q)
+	}
+}
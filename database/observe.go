@@ -0,0 +1,89 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package database
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Observer is notified of the duration and result of database operations.
+// The name is the name of the Database method that issued the operation.
+// Commands sent through Do, including scripts, are observed individually.
+// A pipeline is observed once, from the first Send until the last reply is
+// received.
+type Observer interface {
+	ObserveOp(name string, dur time.Duration, err error)
+}
+
+// conn returns a connection from the pool that reports operations to the
+// database observer under the given name.
+func (db *Database) conn(name string) redis.Conn {
+	return db.observe(name, db.Pool.Get())
+}
+
+// observe returns c wrapped to report operations to the database observer
+// under the given name.
+func (db *Database) observe(name string, c redis.Conn) redis.Conn {
+	if db.Observer == nil {
+		return c
+	}
+	return &observedConn{Conn: c, name: name, o: db.Observer}
+}
+
+type observedConn struct {
+	redis.Conn
+	name    string
+	o       Observer
+	pending int
+	start   time.Time
+	err     error
+}
+
+func (c *observedConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	if c.pending > 0 {
+		// Do flushes the pipeline and receives all pending replies.
+		start = c.start
+		c.pending = 0
+	}
+	reply, err := c.Conn.Do(cmd, args...)
+	c.o.ObserveOp(c.name, time.Since(start), err)
+	return reply, err
+}
+
+func (c *observedConn) Send(cmd string, args ...interface{}) error {
+	if c.pending == 0 {
+		c.start = time.Now()
+		c.err = nil
+	}
+	c.pending++
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *observedConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	if c.pending > 0 {
+		c.pending--
+		if c.pending == 0 {
+			c.o.ObserveOp(c.name, time.Since(c.start), c.err)
+		}
+	}
+	return reply, err
+}
@@ -12,120 +12,227 @@
 // License for the specific language governing permissions and limitations
 // under the License.
 
-// This file implements the Paice/Husk stemming algorithm.
-// http://www.comp.lancs.ac.uk/computing/research/stemming/Links/paice.htm
+// This file implements the Porter stemming algorithm. The implementation
+// follows Martin Porter's ANSI C reference version.
+// http://tartarus.org/martin/PorterStemmer/
 
 package database
 
 import (
 	"bytes"
-	"regexp"
-	"strconv"
 )
 
-const stemRuleText = `
-ai*2. a*1. 
-bb1. 
-city3s. ci2> cn1t> 
-dd1. dei3y> deec2ss. dee1. de2> dooh4> 
-e1> 
-feil1v. fi2> 
-gni3> gai3y. ga2> gg1. 
-ht*2. hsiug5ct. hsi3> 
-i*1. i1y> 
-ji1d. juf1s. ju1d. jo1d. jeh1r. jrev1t. jsim2t. jn1d. j1s. 
-lbaifi6. lbai4y. lba3> lbi3. lib2l> lc1. lufi4y. luf3> lu2. lai3> lau3> la2> ll1. 
-mui3. mu*2. msi3> mm1. 
-nois4j> noix4ct. noi3> nai3> na2> nee0. ne2> nn1. 
-pihs4> pp1. 
-re2> rae0. ra2. ro2> ru2> rr1. rt1> rei3y> 
-sei3y> sis2. si2> ssen4> ss0. suo3> su*2. s*1> s0. 
-tacilp4y. ta2> tnem4> tne3> tna3> tpir2b. tpro2b. tcud1. tpmus2. tpec2iv. tulo2v. tsis0. tsi3> tt1. 
-uqi3. ugo1. 
-vis3j> vie0. vi2> 
-ylb1> yli3y> ylp0. yl2> ygo1. yhp1. ymo1. ypo1. yti3> yte3> ytl2. yrtsi5. yra3> yro3> yfi3. ycn2t> yca3> 
-zi2> zy1s. 
-`
-
-type stemRule struct {
-	text   string
-	suffix []byte
-	intact bool
-	remove int
-	append []byte
-	more   bool
-}
-
-func parseStemRules() map[byte][]*stemRule {
-
-	rules := make(map[byte][]*stemRule)
-	for _, m := range regexp.MustCompile(`(?m)(?:^| )([a-zA-Z]*)(\*?)([0-9])([a-zA-z]*)([.>])`).FindAllStringSubmatch(stemRuleText, -1) {
-
-		suffix := []byte(m[1])
-		for i := 0; i < len(suffix)/2; i++ {
-			j := len(suffix) - 1 - i
-			suffix[i], suffix[j] = suffix[j], suffix[i]
+// stemmer holds the word being stemmed. The stem is b[:k+1]. The methods
+// that test a suffix set j to the end of the stem without the suffix.
+type stemmer struct {
+	b    []byte
+	k, j int
+}
+
+// cons returns true if b[i] is a consonant.
+func (z *stemmer) cons(i int) bool {
+	switch z.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !z.cons(i-1)
+	}
+	return true
+}
+
+// m returns the number of consonant sequences in b[:j+1] following a vowel
+// sequence.
+func (z *stemmer) m() int {
+	n := 0
+	i := 0
+	for ; i <= z.j && z.cons(i); i++ {
+	}
+	for i <= z.j {
+		for ; i <= z.j && !z.cons(i); i++ {
+		}
+		if i > z.j {
+			break
 		}
+		n++
+		for ; i <= z.j && z.cons(i); i++ {
+		}
+	}
+	return n
+}
 
-		remove, _ := strconv.Atoi(m[3])
-		r := &stemRule{
-			text:   m[0],
-			suffix: suffix,
-			intact: m[2] == "*",
-			remove: remove,
-			append: []byte(m[4]),
-			more:   m[5] == ">",
+// vowelInStem returns true if b[:j+1] contains a vowel.
+func (z *stemmer) vowelInStem() bool {
+	for i := 0; i <= z.j; i++ {
+		if !z.cons(i) {
+			return true
 		}
-		c := suffix[len(suffix)-1]
-		rules[c] = append(rules[c], r)
 	}
-	return rules
+	return false
+}
+
+// doubleCons returns true if b[i-1:i+1] is a double consonant.
+func (z *stemmer) doubleCons(i int) bool {
+	return i >= 1 && z.b[i] == z.b[i-1] && z.cons(i)
+}
+
+// cvc returns true if b[i-2:i+1] is consonant-vowel-consonant and the
+// second consonant is not w, x or y.
+func (z *stemmer) cvc(i int) bool {
+	if i < 2 || !z.cons(i) || z.cons(i-1) || !z.cons(i-2) {
+		return false
+	}
+	switch z.b[i] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
 }
 
-var stemRules = parseStemRules()
+// ends returns true if the stem ends with s.
+func (z *stemmer) ends(s string) bool {
+	if len(s) > z.k+1 || !bytes.HasSuffix(z.b[:z.k+1], []byte(s)) {
+		return false
+	}
+	z.j = z.k - len(s)
+	return true
+}
+
+// setTo replaces the suffix following b[:j+1] with s.
+func (z *stemmer) setTo(s string) {
+	z.b = append(z.b[:z.j+1], s...)
+	z.k = z.j + len(s)
+}
 
-func firstVowel(offset int, p []byte) int {
-	for i, b := range p {
-		switch b {
-		case 'a', 'e', 'i', 'o', 'u':
-			return offset + i
-		case 'y':
-			if offset+i > 0 {
-				return offset + i
+// replace replaces the suffix with s if m() > 0.
+func (z *stemmer) replace(s string) {
+	if z.m() > 0 {
+		z.setTo(s)
+	}
+}
+
+// step1ab removes plurals, -ed and -ing.
+func (z *stemmer) step1ab() {
+	if z.b[z.k] == 's' {
+		switch {
+		case z.ends("sses"):
+			z.k -= 2
+		case z.ends("ies"):
+			z.setTo("i")
+		case z.b[z.k-1] != 's':
+			z.k--
+		}
+	}
+	if z.ends("eed") {
+		if z.m() > 0 {
+			z.k--
+		}
+	} else if (z.ends("ed") || z.ends("ing")) && z.vowelInStem() {
+		z.k = z.j
+		switch {
+		case z.ends("at"):
+			z.setTo("ate")
+		case z.ends("bl"):
+			z.setTo("ble")
+		case z.ends("iz"):
+			z.setTo("ize")
+		case z.doubleCons(z.k):
+			switch z.b[z.k] {
+			case 'l', 's', 'z':
+			default:
+				z.k--
+			}
+		default:
+			z.j = z.k
+			if z.m() == 1 && z.cvc(z.k) {
+				z.setTo("e")
 			}
 		}
 	}
-	return -1
 }
 
-func acceptableStem(a, b []byte) bool {
-	i := firstVowel(0, a)
-	if i < 0 {
-		i = firstVowel(len(a), b)
+// step1c turns a terminal y to i when there is another vowel in the stem.
+func (z *stemmer) step1c() {
+	if z.ends("y") && z.vowelInStem() {
+		z.b[z.k] = 'i'
 	}
-	l := len(a) + len(b)
-	if i == 0 {
-		return l > 1
+}
+
+type suffixRule struct {
+	suffix, replacement string
+}
+
+// step2Rules and step3Rules map double and single suffixes to shorter ones.
+var step2Rules = []suffixRule{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"},
+	{"izer", "ize"}, {"bli", "ble"}, {"alli", "al"}, {"entli", "ent"},
+	{"eli", "e"}, {"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"},
+	{"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"},
+	{"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+	{"logi", "log"},
+}
+
+var step3Rules = []suffixRule{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"},
+	{"ical", "ic"}, {"ful", ""}, {"ness", ""},
+}
+
+func (z *stemmer) applyRules(rules []suffixRule) {
+	for _, r := range rules {
+		if z.ends(r.suffix) {
+			z.replace(r.replacement)
+			return
+		}
 	}
-	return i >= 0 && l > 2
 }
 
-func stem(s string) string {
-	stem := bytes.ToLower([]byte(s))
-	intact := true
-	run := acceptableStem(stem, []byte{})
-	for run {
-		run = false
-		for _, rule := range stemRules[stem[len(stem)-1]] {
-			if bytes.HasSuffix(stem, rule.suffix) &&
-				(intact || !rule.intact) &&
-				acceptableStem(stem[:len(stem)-rule.remove], rule.append) {
-				stem = append(stem[:len(stem)-rule.remove], rule.append...)
-				intact = false
-				run = rule.more
-				break
-			}
+// step4Suffixes are removed when m() > 1.
+var step4Suffixes = []string{
+	"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment",
+	"ent", "ion", "ou", "ism", "ate", "iti", "ous", "ive", "ize",
+}
+
+func (z *stemmer) step4() {
+	for _, s := range step4Suffixes {
+		if !z.ends(s) {
+			continue
+		}
+		if s == "ion" && (z.j < 0 || z.b[z.j] != 's' && z.b[z.j] != 't') {
+			return
+		}
+		if z.m() > 1 {
+			z.k = z.j
+		}
+		return
+	}
+}
+
+// step5 removes a final -e and changes -ll to -l when m() > 1.
+func (z *stemmer) step5() {
+	z.j = z.k
+	if z.b[z.k] == 'e' {
+		a := z.m()
+		if a > 1 || a == 1 && !z.cvc(z.k-1) {
+			z.k--
 		}
 	}
-	return string(stem)
+	if z.b[z.k] == 'l' && z.doubleCons(z.k) && z.m() > 1 {
+		z.k--
+	}
+}
+
+func stem(s string) string {
+	z := stemmer{b: bytes.ToLower([]byte(s))}
+	z.k = len(z.b) - 1
+	if z.k <= 1 {
+		return string(z.b)
+	}
+	z.step1ab()
+	if z.k > 0 {
+		z.step1c()
+		z.applyRules(step2Rules)
+		z.applyRules(step3Rules)
+		z.step4()
+		z.step5()
+	}
+	return string(z.b[:z.k+1])
 }
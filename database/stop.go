@@ -28,6 +28,15 @@ func createStopWordMap() map[string]bool {
 	return m
 }
 
+// SetStopWords adds words to the default set of stop words. Call this
+// function before the database is used. Packages indexed before the change
+// keep their terms for the new stop words until they are put again.
+func SetStopWords(words []string) {
+	for _, s := range words {
+		stopWord[strings.ToLower(s)] = true
+	}
+}
+
 const stopText = `
 a
 about
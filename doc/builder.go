@@ -49,6 +49,33 @@ var badSynopsisPrefixes = []string{
 	"vim:",
 }
 
+// abbreviations is the set of abbreviations that do not end a sentence in a
+// synopsis.
+var abbreviations = map[string]bool{
+	"e.g.": true,
+	"i.e.": true,
+	"etc.": true,
+	"vs.":  true,
+}
+
+// isAbbreviation returns true if the last word in p is an abbreviation.
+func isAbbreviation(p []byte) bool {
+	w := p[bytes.LastIndex(p, []byte{' '})+1:]
+	w = bytes.TrimLeft(w, "(")
+	return abbreviations[strings.ToLower(string(w))]
+}
+
+// isDeprecated returns true if a paragraph of the package documentation s
+// starts with "Deprecated:".
+func isDeprecated(s string) bool {
+	for _, p := range strings.Split(s, "\n\n") {
+		if strings.HasPrefix(strings.TrimSpace(p), "Deprecated:") {
+			return true
+		}
+	}
+	return false
+}
+
 // synopsis extracts the first sentence from s. All runs of whitespace are
 // replaced by a single space.
 func synopsis(s string) string {
@@ -70,7 +97,11 @@ Loop:
 		case ' ', '\t', '\r', '\n':
 			switch last {
 			case period:
-				break Loop
+				if !isAbbreviation(buf) {
+					break Loop
+				}
+				buf = append(buf, ' ')
+				last = space
 			case other:
 				buf = append(buf, ' ')
 				last = space
@@ -84,14 +115,20 @@ Loop:
 		}
 	}
 
-	// Ensure that synopsis fits an App Engine datastore text property.
+	// Ensure that synopsis fits an App Engine datastore text property. Cut at
+	// a word boundary if possible and never in the middle of a rune.
 	const m = 400
 	if len(buf) > m {
-		buf = buf[:m]
+		const ellipsis = " ..."
+		i := m - len(ellipsis)
+		for i > 0 && !utf8.RuneStart(buf[i]) {
+			i--
+		}
+		buf = buf[:i]
 		if i := bytes.LastIndex(buf, []byte{' '}); i >= 0 {
 			buf = buf[:i]
 		}
-		buf = append(buf, " ..."...)
+		buf = append(buf, ellipsis...)
 	}
 
 	s = string(buf)
@@ -396,6 +433,10 @@ type Package struct {
 	// Packages referenced in README files.
 	References []string
 
+	// SPDX identifier of the license found in the package directory or "" if
+	// no license is detected.
+	License string
+
 	// Version control system: git, hg, bzr, ...
 	VCS string
 
@@ -423,9 +464,16 @@ type Package struct {
 	// True if package documentation is incomplete.
 	Truncated bool
 
+	// True if the package documentation marks the package as deprecated.
+	Deprecated bool
+
 	// Environment
 	GOOS, GOARCH string
 
+	// GOOS and GOARCH values named in file names and build constraints. The
+	// slice is empty if the package has no platform specific files.
+	Platforms []string
+
 	// Top-level declarations.
 	Consts []*Value
 	Funcs  []*Func
@@ -454,13 +502,33 @@ type Package struct {
 	XTestImports []string
 }
 
-var goEnvs = []struct{ GOOS, GOARCH string }{
+type goEnv struct{ GOOS, GOARCH string }
+
+// goEnvs are the platforms tried in order when the caller does not select a
+// platform. The first platform with matching files is documented.
+var goEnvs = []goEnv{
 	{"linux", "amd64"},
 	{"darwin", "amd64"},
 	{"windows", "amd64"},
 }
 
-func newPackage(dir *gosrc.Directory) (*Package, error) {
+// buildEnvs returns the platforms to try for the given GOOS and GOARCH. If
+// both are empty, buildEnvs returns goEnvs. Otherwise, an empty value
+// defaults to the value in the first of goEnvs.
+func buildEnvs(goos, goarch string) []goEnv {
+	if goos == "" && goarch == "" {
+		return goEnvs
+	}
+	if goos == "" {
+		goos = goEnvs[0].GOOS
+	}
+	if goarch == "" {
+		goarch = goEnvs[0].GOARCH
+	}
+	return []goEnv{{goos, goarch}}
+}
+
+func newPackage(dir *gosrc.Directory, goos, goarch string) (*Package, error) {
 
 	pkg := &Package{
 		Updated:        time.Now().UTC(),
@@ -478,12 +546,17 @@ func newPackage(dir *gosrc.Directory) (*Package, error) {
 	var b builder
 	b.srcs = make(map[string]*source)
 	references := make(map[string]bool)
+	platforms := make(map[string]bool)
 	for _, file := range dir.Files {
 		if strings.HasSuffix(file.Name, ".go") {
+			platformTags(platforms, file.Name, file.Data)
 			gosrc.OverwriteLineComments(file.Data)
 			b.srcs[file.Name] = &source{name: file.Name, browseURL: file.BrowseURL, data: file.Data}
 		} else {
 			addReferences(references, file.Data)
+			if isLicenseFile(file.Name) && pkg.License == "" {
+				pkg.License = detectLicense(file.Data)
+			}
 		}
 	}
 
@@ -491,6 +564,11 @@ func newPackage(dir *gosrc.Directory) (*Package, error) {
 		pkg.References = append(pkg.References, r)
 	}
 
+	for p := range platforms {
+		pkg.Platforms = append(pkg.Platforms, p)
+	}
+	sort.Strings(pkg.Platforms)
+
 	if len(b.srcs) == 0 {
 		return pkg, nil
 	}
@@ -511,7 +589,7 @@ func newPackage(dir *gosrc.Directory) (*Package, error) {
 	var err error
 	var bpkg *build.Package
 
-	for _, env := range goEnvs {
+	for _, env := range buildEnvs(goos, goarch) {
 		ctxt.GOOS = env.GOOS
 		ctxt.GOARCH = env.GOARCH
 		bpkg, err = dir.Import(&ctxt, 0)
@@ -585,11 +663,15 @@ func newPackage(dir *gosrc.Directory) (*Package, error) {
 	pkg.GOOS = ctxt.GOOS
 	pkg.GOARCH = ctxt.GOARCH
 
-	pkg.Consts = b.values(dpkg.Consts)
-	pkg.Funcs = b.funcs(dpkg.Funcs)
-	pkg.Types = b.types(dpkg.Types)
-	pkg.Vars = b.values(dpkg.Vars)
+	// The declarations in a command are not part of its documentation.
+	if !pkg.IsCmd {
+		pkg.Consts = b.values(dpkg.Consts)
+		pkg.Funcs = b.funcs(dpkg.Funcs)
+		pkg.Types = b.types(dpkg.Types)
+		pkg.Vars = b.values(dpkg.Vars)
+	}
 	pkg.Notes = b.notes(dpkg.Notes)
+	pkg.Deprecated = isDeprecated(pkg.Doc) || len(pkg.Notes["DEPRECATED"]) > 0
 
 	pkg.Imports = bpkg.Imports
 	pkg.TestImports = bpkg.TestImports
@@ -16,7 +16,14 @@ package doc
 
 import (
 	"go/ast"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 var badSynopsis = []string{
@@ -35,6 +42,224 @@ func TestBadSynopsis(t *testing.T) {
 	}
 }
 
+var synopsisTests = []struct {
+	s, synopsis string
+}{
+	{"Package foo implements e.g. parsing. More text.", "Package foo implements e.g. parsing."},
+	{"Package foo parses (i.e. reads) files.\nMore text.", "Package foo parses (i.e. reads) files."},
+	{"Package foo supports v1.2 of the protocol. More text.", "Package foo supports v1.2 of the protocol."},
+	{"Package foo reads JSON, XML, etc. and writes them. More.", "Package foo reads JSON, XML, etc. and writes them."},
+	{"Package foo.  Big   spaces.", "Package foo."},
+}
+
+func TestSynopsis(t *testing.T) {
+	for _, tt := range synopsisTests {
+		if s := synopsis(tt.s); s != tt.synopsis {
+			t.Errorf("synopsis(%q) = %q, want %q", tt.s, s, tt.synopsis)
+		}
+	}
+}
+
+var deprecatedTests = []struct {
+	s        string
+	expected bool
+}{
+	{"Package foo reads files.", false},
+	{"Package foo reads files.\n\nDeprecated: Use package bar instead.", true},
+	{"DEPRECATED: use bar.", false},
+	{"Package foo reads files. The FooV1 API is DEPRECATED.", false},
+	{"Package foo is not deprecated.", false},
+	{"Package foo reads files. Deprecated: is not at the start of a paragraph.", false},
+}
+
+func TestIsDeprecated(t *testing.T) {
+	for _, tt := range deprecatedTests {
+		if actual := isDeprecated(tt.s); actual != tt.expected {
+			t.Errorf("isDeprecated(%q) = %v, want %v", tt.s, actual, tt.expected)
+		}
+	}
+}
+
+func TestLongSynopsis(t *testing.T) {
+	for _, s := range []string{
+		"x" + strings.Repeat("é", 300),
+		"Package p " + strings.Repeat("é", 30) + " " + strings.Repeat("世", 200),
+		strings.Repeat("word ", 100),
+	} {
+		syn := synopsis(s)
+		if !utf8.ValidString(syn) || len(syn) > 400 || !strings.HasSuffix(syn, " ...") {
+			t.Errorf("synopsis(%q) = %q, want valid UTF-8 ending with \" ...\" and at most 400 bytes", s, syn)
+		}
+	}
+}
+
+const exampleTestFile = `package p_test
+
+func Example() {}
+
+func ExampleFoo() {
+	Foo()
+	// Output: foo
+}
+
+func ExampleFoo_second() {}
+
+func ExampleFooBar() {}
+
+func ExampleT_M() {}
+
+func ExampleT_M_second() {}
+`
+
+var getExamplesTests = []struct {
+	name  string
+	names []string
+}{
+	{"", []string{""}},
+	{"Foo", []string{"", "Second"}},
+	{"FooBar", []string{""}},
+	{"T", nil},
+	{"T_M", []string{"", "Second"}},
+}
+
+func TestGetExamples(t *testing.T) {
+	var b builder
+	b.fset = token.NewFileSet()
+	file, err := parser.ParseFile(b.fset, "p_test.go", exampleTestFile, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.examples = doc.Examples(file)
+	for _, tt := range getExamplesTests {
+		var names []string
+		for _, e := range b.getExamples(tt.name) {
+			names = append(names, e.Name)
+		}
+		if !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("getExamples(%q) returned names %q, want %q", tt.name, names, tt.names)
+		}
+	}
+	if e := b.getExamples("Foo")[0]; e.Code.Text != "Foo()" || e.Output != "foo\n" {
+		t.Errorf("getExamples(Foo)[0] = {Code: %q, Output: %q}, want {Code: \"Foo()\", Output: \"foo\\n\"}", e.Code.Text, e.Output)
+	}
+}
+
+const declFile = `package p
+
+import "io"
+
+type T struct {
+	R io.Reader
+	U U
+	n int
+}
+
+type U int
+`
+
+func TestPrintDecl(t *testing.T) {
+	var b builder
+	b.fset = token.NewFileSet()
+	file, err := parser.ParseFile(b.fset, "p.go", declFile, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ast.NewPackage(b.fset, map[string]*ast.File{"p.go": file}, simpleImporter, nil)
+	code := b.printDecl(file.Decls[1])
+
+	type span struct {
+		kind AnnotationKind
+		text string
+		path string
+	}
+	var got []span
+	for _, a := range code.Annotations {
+		sp := span{kind: a.Kind, text: code.Text[a.Pos:a.End]}
+		if a.PathIndex >= 0 {
+			sp.path = code.Paths[a.PathIndex]
+		}
+		got = append(got, sp)
+	}
+	want := []span{
+		{AnchorAnnotation, "R", ""},
+		{PackageLinkAnnotation, "io", "io"},
+		{LinkAnnotation, "Reader", "io"},
+		{AnchorAnnotation, "U", ""},
+		{LinkAnnotation, "U", ""},
+		{AnchorAnnotation, "n", ""},
+		{BuiltinAnnotation, "int", ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("printDecl annotations = %v, want %v", got, want)
+	}
+}
+
+const notesFile = `// Package p has notes.
+package p
+
+// BUG(gary): F fails on Sundays.
+
+// F does nothing.
+//
+// BUG(bob): F is slow.
+func F() {}
+
+// TODO(gary): add G.
+`
+
+func TestNotes(t *testing.T) {
+	var b builder
+	b.fset = token.NewFileSet()
+	b.srcs = map[string]*source{"p.go": {name: "p.go"}}
+	file, err := parser.ParseFile(b.fset, "p.go", notesFile, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apkg, _ := ast.NewPackage(b.fset, map[string]*ast.File{"p.go": file}, simpleImporter, nil)
+	notes := b.notes(doc.New(apkg, "p", 0).Notes)
+
+	type note struct {
+		Line int32
+		UID  string
+		Body string
+	}
+	got := make(map[string][]note)
+	for tag, values := range notes {
+		for _, n := range values {
+			got[tag] = append(got[tag], note{n.Pos.Line, n.UID, n.Body})
+		}
+	}
+	want := map[string][]note{
+		"BUG":  {{4, "gary", "F fails on Sundays."}, {8, "bob", "F is slow."}},
+		"TODO": {{11, "gary", "add G."}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("notes = %v, want %v", got, want)
+	}
+}
+
+const alignFile = `package p
+
+type T struct {
+	A int // a
+	Bcde string // bcde
+}
+`
+
+func TestPrintDeclAlignment(t *testing.T) {
+	var b builder
+	b.fset = token.NewFileSet()
+	file, err := parser.ParseFile(b.fset, "p.go", alignFile, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := b.printDecl(file.Decls[0])
+	want := "type T struct {\n\tA    int    // a\n\tBcde string // bcde\n}"
+	if code.Text != want {
+		t.Errorf("printDecl text = %q, want %q", code.Text, want)
+	}
+}
+
 const readme = `
     $ go get github.com/user/repo/pkg1
     [foo](http://gopkgdoc.appspot.com/pkg/github.com/user/repo/pkg2)
@@ -99,3 +324,77 @@ func TestSimpleImporter(t *testing.T) {
 		}
 	}
 }
+
+var detectLicenseTests = []struct {
+	text string
+	id   string
+}{
+	{"                Apache License\n           Version 2.0, January 2004", "Apache-2.0"},
+	{"Licensed under the Apache License, Version 2.0 (the \"License\")", "Apache-2.0"},
+	{"The MIT License (MIT)\n\nPermission is hereby granted, free of charge, to any person", "MIT"},
+	{"Redistribution and use in source and binary forms, with or without\nmodification, are permitted.\n\n* Neither the name of Google Inc.", "BSD-3-Clause"},
+	{"Redistribution and use in source and binary forms, with or without\nmodification, are permitted.", "BSD-2-Clause"},
+	{"GNU GENERAL PUBLIC LICENSE\nVersion 3, 29 June 2007", "GPL-3.0"},
+	{"All rights reserved.", ""},
+}
+
+func TestDetectLicense(t *testing.T) {
+	for _, tt := range detectLicenseTests {
+		if id := detectLicense([]byte(tt.text)); id != tt.id {
+			t.Errorf("detectLicense(%q) = %q, want %q", tt.text, id, tt.id)
+		}
+	}
+}
+
+var buildEnvsTests = []struct {
+	goos, goarch string
+	expected     []goEnv
+}{
+	{"", "", goEnvs},
+	{"windows", "386", []goEnv{{"windows", "386"}}},
+	{"darwin", "", []goEnv{{"darwin", "amd64"}}},
+	{"", "arm", []goEnv{{"linux", "arm"}}},
+}
+
+func TestBuildEnvs(t *testing.T) {
+	for _, tt := range buildEnvsTests {
+		if actual := buildEnvs(tt.goos, tt.goarch); !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("buildEnvs(%q, %q) = %v, want %v", tt.goos, tt.goarch, actual, tt.expected)
+		}
+	}
+}
+
+var platformTagsTests = []struct {
+	name string
+	data string
+	tags []string
+}{
+	{"file.go", "package foo", nil},
+	{"file_windows.go", "package foo", []string{"windows"}},
+	{"file_linux_arm.go", "package foo", []string{"arm", "linux"}},
+	{"file_amd64_test.go", "package foo", nil},
+	{"file_windows_test.go", "// +build windows\n\npackage foo", nil},
+	{"linux.go", "package foo", nil},
+	{"file.go", "// +build darwin,386 freebsd\n\npackage foo", []string{"386", "darwin", "freebsd"}},
+	{"file.go", "// +build darwin,386 freebsd !windows\n\npackage foo", nil},
+	{"file.go", "// +build !windows\n\npackage foo", nil},
+	{"file.go", "// +build linux,!arm\n\npackage foo", []string{"linux"}},
+	{"file_linux.go", "// +build !cgo\n\npackage foo", []string{"linux"}},
+	{"file.go", "// +build ignore\n\npackage foo", nil},
+	{"file.go", "package foo\n\n// +build linux", nil},
+}
+
+func TestPlatformTags(t *testing.T) {
+	for _, tt := range platformTagsTests {
+		m := make(map[string]bool)
+		platformTags(m, tt.name, []byte(tt.data))
+		var tags []string
+		for tag := range m {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		if !reflect.DeepEqual(tags, tt.tags) {
+			t.Errorf("platformTags(%q, %q) = %v, want %v", tt.name, tt.data, tags, tt.tags)
+		}
+	}
+}
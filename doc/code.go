@@ -77,6 +77,11 @@ var predeclared = map[string]int{
 	"recover": predeclaredFunction,
 }
 
+// PrintConfig is the printer configuration used to format declarations and
+// examples. The default indents with tabs and aligns with spaces as gofmt
+// does. Set Mode to printer.UseSpaces to indent with spaces.
+var PrintConfig = printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 4}
+
 type AnnotationKind int16
 
 const (
@@ -219,7 +224,7 @@ func (b *builder) printDecl(decl ast.Decl) (d Code) {
 	v := &annotationVisitor{pathIndex: make(map[string]int)}
 	ast.Walk(v, decl)
 	b.buf = b.buf[:0]
-	err := (&printer.Config{Mode: printer.UseSpaces, Tabwidth: 4}).Fprint(sliceWriter{&b.buf}, b.fset, decl)
+	err := PrintConfig.Fprint(sliceWriter{&b.buf}, b.fset, decl)
 	if err != nil {
 		return Code{Text: err.Error()}
 	}
@@ -281,7 +286,7 @@ func (b *builder) printExample(e *doc.Example) (code Code, output string) {
 	output = e.Output
 
 	b.buf = b.buf[:0]
-	err := (&printer.Config{Mode: printer.UseSpaces, Tabwidth: 4}).Fprint(
+	err := PrintConfig.Fprint(
 		sliceWriter{&b.buf},
 		b.fset,
 		&printer.CommentedNode{
@@ -297,7 +302,11 @@ func (b *builder) printExample(e *doc.Example) (code Code, output string) {
 		// remove surrounding braces
 		b.buf = b.buf[1 : i-1]
 		// unindent
-		b.buf = bytes.Replace(b.buf, []byte("\n    "), []byte("\n"), -1)
+		indent := []byte("\n\t")
+		if PrintConfig.Mode&printer.TabIndent == 0 {
+			indent = append([]byte{'\n'}, bytes.Repeat([]byte{' '}, PrintConfig.Tabwidth)...)
+		}
+		b.buf = bytes.Replace(b.buf, indent, []byte("\n"), -1)
 		// remove output comment
 		if j := exampleOutputRx.FindIndex(b.buf); j != nil {
 			b.buf = bytes.TrimSpace(b.buf[:j[0]])
@@ -22,7 +22,17 @@ import (
 	"strings"
 )
 
+// Get fetches and builds the documentation for the package with the given
+// import path. The files for the first of linux/amd64, darwin/amd64 and
+// windows/amd64 with matching files are documented.
 func Get(client *http.Client, importPath string, etag string) (*Package, error) {
+	return GetPlatform(client, importPath, etag, "", "")
+}
+
+// GetPlatform is like Get, but documents the files that build for the given
+// GOOS and GOARCH. An empty GOOS or GOARCH defaults to linux or amd64. If
+// both are empty, GetPlatform is the same as Get.
+func GetPlatform(client *http.Client, importPath string, etag string, goos, goarch string) (*Package, error) {
 
 	const versionPrefix = PackageVersion + "-"
 
@@ -37,7 +47,7 @@ func Get(client *http.Client, importPath string, etag string) (*Package, error)
 		return nil, err
 	}
 
-	pdoc, err := newPackage(dir)
+	pdoc, err := newPackage(dir, goos, goarch)
 	if err != nil {
 		return pdoc, err
 	}
@@ -0,0 +1,58 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"regexp"
+	"strings"
+)
+
+func isLicenseFile(name string) bool {
+	name = strings.ToUpper(name)
+	return strings.HasPrefix(name, "LICENSE") ||
+		strings.HasPrefix(name, "LICENCE") ||
+		strings.HasPrefix(name, "COPYING")
+}
+
+// licensePats maps license text patterns to SPDX license identifiers. The
+// patterns are checked in order.
+var licensePats = []struct {
+	pat *regexp.Regexp
+	id  string
+}{
+	{regexp.MustCompile(`(?i)apache license,?\s+version 2\.0`), "Apache-2.0"},
+	{regexp.MustCompile(`(?i)mozilla public license,?\s+version 2\.0`), "MPL-2.0"},
+	{regexp.MustCompile(`(?i)gnu lesser general public license\s+version 3`), "LGPL-3.0"},
+	{regexp.MustCompile(`(?i)gnu lesser general public license\s+version 2\.1`), "LGPL-2.1"},
+	{regexp.MustCompile(`(?i)gnu affero general public license\s+version 3`), "AGPL-3.0"},
+	{regexp.MustCompile(`(?i)gnu general public license\s+version 3`), "GPL-3.0"},
+	{regexp.MustCompile(`(?i)gnu general public license\s+version 2`), "GPL-2.0"},
+	{regexp.MustCompile(`(?i)permission is hereby granted, free of charge`), "MIT"},
+	{regexp.MustCompile(`(?is)redistribution and use in source and binary forms.*neither the name`), "BSD-3-Clause"},
+	{regexp.MustCompile(`(?i)redistribution and use in source and binary forms`), "BSD-2-Clause"},
+	{regexp.MustCompile(`(?i)permission to use, copy, modify, and(?:/or)? distribute this software for any\s+purpose with or without fee`), "ISC"},
+	{regexp.MustCompile(`(?i)this is free and unencumbered software released into the public domain`), "Unlicense"},
+}
+
+// detectLicense returns the SPDX identifier for the license text in p or ""
+// if the license is not recognized.
+func detectLicense(p []byte) string {
+	for _, lp := range licensePats {
+		if lp.pat.Match(p) {
+			return lp.id
+		}
+	}
+	return ""
+}
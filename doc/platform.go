@@ -0,0 +1,115 @@
+// Copyright 2013 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"bytes"
+	"strings"
+)
+
+var knownOS = map[string]bool{
+	"android":   true,
+	"darwin":    true,
+	"dragonfly": true,
+	"freebsd":   true,
+	"linux":     true,
+	"nacl":      true,
+	"netbsd":    true,
+	"openbsd":   true,
+	"plan9":     true,
+	"solaris":   true,
+	"windows":   true,
+}
+
+var knownArch = map[string]bool{
+	"386":      true,
+	"amd64":    true,
+	"arm":      true,
+	"arm64":    true,
+	"mips":     true,
+	"mipsle":   true,
+	"mips64":   true,
+	"mips64le": true,
+	"ppc64":    true,
+	"ppc64le":  true,
+	"s390x":    true,
+}
+
+// IsKnownOS returns true if s is a GOOS value.
+func IsKnownOS(s string) bool { return knownOS[s] }
+
+// IsKnownArch returns true if s is a GOARCH value.
+func IsKnownArch(s string) bool { return knownArch[s] }
+
+// platformTags adds the GOOS and GOARCH values named in the file name and
+// the +build lines of a Go source file to tags. Test files are skipped
+// because they are not part of the package build. A +build line with an
+// option that does not name a GOOS or GOARCH value, such as !windows, does
+// not restrict the platforms of the file and is ignored.
+func platformTags(tags map[string]bool, name string, data []byte) {
+	if strings.HasSuffix(name, "_test.go") {
+		return
+	}
+
+	// The file name rules are those used by go/build: name_GOOS_GOARCH,
+	// name_GOOS or name_GOARCH.
+	name = strings.TrimSuffix(name, ".go")
+	if i := strings.Index(name, "_"); i >= 0 {
+		l := strings.Split(name[i:], "_")
+		n := len(l)
+		if n >= 2 && knownOS[l[n-2]] && knownArch[l[n-1]] {
+			tags[l[n-2]] = true
+			tags[l[n-1]] = true
+		} else if n >= 1 && (knownOS[l[n-1]] || knownArch[l[n-1]]) {
+			tags[l[n-1]] = true
+		}
+	}
+
+	// Build constraints appear in line comments before the package clause.
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if !bytes.HasPrefix(line, []byte("//")) {
+			break
+		}
+		line = bytes.TrimSpace(line[len("//"):])
+		if !bytes.HasPrefix(line, []byte("+build ")) {
+			continue
+		}
+		// The file builds if any option is satisfied. An option is
+		// satisfied if all of its comma separated terms are satisfied.
+		var lineTags []string
+		restricted := true
+		for _, option := range strings.Fields(string(line[len("+build "):])) {
+			n := len(lineTags)
+			for _, t := range strings.Split(option, ",") {
+				if knownOS[t] || knownArch[t] {
+					lineTags = append(lineTags, t)
+				}
+			}
+			if len(lineTags) == n {
+				restricted = false
+				break
+			}
+		}
+		if restricted {
+			for _, t := range lineTags {
+				tags[t] = true
+			}
+		}
+	}
+}
@@ -31,8 +31,10 @@ import (
 )
 
 var (
-	etag  = flag.String("etag", "", "Etag")
-	local = flag.Bool("local", false, "Get package from local directory.")
+	etag   = flag.String("etag", "", "Etag")
+	local  = flag.Bool("local", false, "Get package from local directory.")
+	goos   = flag.String("goos", "", "GOOS of the files to document.")
+	goarch = flag.String("goarch", "", "GOARCH of the files to document.")
 )
 
 func main() {
@@ -49,7 +51,7 @@ func main() {
 	if *local {
 		gosrc.SetLocalDevMode(os.Getenv("GOPATH"))
 	}
-	pdoc, err = doc.Get(http.DefaultClient, path, *etag)
+	pdoc, err = doc.GetPlatform(http.DefaultClient, path, *etag, *goos, *goarch)
 	//}
 	if err != nil {
 		log.Fatal(err)
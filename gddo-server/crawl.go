@@ -95,7 +95,7 @@ func crawlDoc(source string, importPath string, pdoc *doc.Package, hasSubdirs bo
 	switch {
 	case err == nil:
 		message = append(message, "put:", pdoc.Etag)
-		if err := db.Put(pdoc, nextCrawl); err != nil {
+		if _, err := db.Put(pdoc, nextCrawl); err != nil {
 			log.Printf("ERROR db.Put(%q): %v", importPath, err)
 		}
 	case err == gosrc.ErrNotModified:
@@ -108,6 +108,12 @@ func crawlDoc(source string, importPath string, pdoc *doc.Package, hasSubdirs bo
 		if err := db.Delete(importPath); err != nil {
 			log.Printf("ERROR db.Delete(%q): %v", importPath, err)
 		}
+		if redirect := err.(gosrc.NotFoundError).Redirect; redirect != "" {
+			message = append(message, "redirect:", redirect)
+			if err := db.PutAlias(importPath, redirect); err != nil {
+				log.Printf("ERROR db.PutAlias(%q): %v", importPath, err)
+			}
+		}
 	default:
 		message = append(message, "ERROR:", err)
 		return nil, err
@@ -17,30 +17,17 @@ package main
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"os/exec"
-	"strings"
 
 	"github.com/garyburd/gddo/database"
-	"github.com/garyburd/gddo/doc"
 )
 
-func renderGraph(pdoc *doc.Package, pkgs []database.Package, edges [][2]int) ([]byte, error) {
-	var in, out bytes.Buffer
-
-	fmt.Fprintf(&in, "digraph %s { \n", pdoc.Name)
-	for i, pkg := range pkgs {
-		fmt.Fprintf(&in, " n%d [label=\"%s\", URL=\"/%s\", tooltip=\"%s\"];\n",
-			i, pkg.Path, pkg.Path,
-			strings.Replace(pkg.Synopsis, `"`, `\"`, -1))
-	}
-	for _, edge := range edges {
-		fmt.Fprintf(&in, " n%d -> n%d;\n", edge[0], edge[1])
-	}
-	in.WriteString("}")
+func renderGraph(pkgs []database.Package, edges [][2]int) ([]byte, error) {
+	var out bytes.Buffer
+	in := bytes.NewReader(database.ImportGraphDOT(pkgs, edges))
 
 	cmd := exec.Command("dot", "-Tsvg")
-	cmd.Stdin = &in
+	cmd.Stdin = in
 	cmd.Stdout = &out
 	if err := cmd.Run(); err != nil {
 		return nil, err
@@ -86,6 +86,12 @@ func getDoc(path string, requestType int) (*doc.Package, []database.Package, err
 		return nil, nil, err
 	}
 
+	if pdoc != nil && pdoc.ImportPath != path {
+		// The crawler was redirected from path. Crawl the package stored
+		// under the path it was redirected to.
+		path = pdoc.ImportPath
+	}
+
 	needsCrawl := false
 	switch requestType {
 	case queryRequest:
@@ -385,11 +391,11 @@ func servePackage(resp http.ResponseWriter, req *http.Request) error {
 			break
 		}
 		hide := req.Form.Get("hide") == "1"
-		pkgs, edges, err := db.ImportGraph(pdoc, hide)
+		pkgs, edges, _, err := db.ImportGraph(pdoc, hide, 0, false)
 		if err != nil {
 			return err
 		}
-		b, err := renderGraph(pdoc, pkgs, edges)
+		b, err := renderGraph(pkgs, edges)
 		if err != nil {
 			return err
 		}
@@ -589,6 +595,15 @@ func serveBot(resp http.ResponseWriter, req *http.Request) error {
 	return executeTemplate(resp, "bot.html", http.StatusOK, nil, nil)
 }
 
+func serveHealthz(resp http.ResponseWriter, req *http.Request) error {
+	if err := db.Ping(); err != nil {
+		return err
+	}
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(resp, "ok\n")
+	return nil
+}
+
 func logError(req *http.Request, err error, rv interface{}) {
 	if err != nil {
 		var buf bytes.Buffer
@@ -862,6 +877,7 @@ func main() {
 	r.Add("/-/go").Get(handler(serveGoIndex))
 	r.Add("/-/subrepo").Get(handler(serveGoSubrepoIndex))
 	r.Add("/-/index").Get(handler(serveIndex))
+	r.Add("/-/healthz").Get(handler(serveHealthz))
 	r.Add("/-/refresh").Post(handler(serveRefresh))
 	r.Add("/a/index").Get(http.RedirectHandler("/-/index", 301))
 	r.Add("/about").Get(http.RedirectHandler("/-/about", 301))